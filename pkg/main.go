@@ -17,7 +17,10 @@ func main() {
 	// from Grafana to create different instances of SampleDatasource (per datasource
 	// ID). When datasource configuration changed Dispose method will be called and
 	// new datasource instance created using NewSampleDatasource factory.
-	options := datasource.ManageOpts{}
+	options := datasource.ManageOpts{
+		// Reject settings that cannot be used when they are saved
+		AdmissionHandler: plugin.SettingsAdmission{},
+	}
 	if err := datasource.Manage("hurricaneisland-hmac-datasource", plugin.NewDatasource, options); err != nil {
 		log.DefaultLogger.Error(err.Error())
 		os.Exit(1)
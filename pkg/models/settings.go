@@ -51,34 +51,116 @@ type Observation struct {
 // Info set during plugin initialization, including
 // plaintext and secure settings.
 type PluginSettings struct {
-	ServerUrl  string                `json:"serverUrl"`
-	BasePath   string                `json:"basePath"`
-	AuthMethod string                `json:"authMethod"`
-	Secrets    *SecretPluginSettings `json:"-"`
+	ServerUrl  string `json:"serverUrl"`
+	BasePath   string `json:"basePath"`
+	AuthMethod string `json:"authMethod"`
+	// Maximum datastream lookups in flight when listing things
+	ResourceConcurrency int `json:"resourceConcurrency"`
+	// Maximum queries running at once for this datasource
+	QueryConcurrency int `json:"queryConcurrency"`
+	// Seconds to cache things and datastreams, negative to disable
+	MetadataTtl int `json:"metadataTtl"`
+	// Maximum observations kept in memory, negative to disable caching
+	ObservationCachePoints int `json:"observationCachePoints"`
+	// Minutes before recent observations are cached as complete
+	ObservationSettleMinutes int `json:"observationSettleMinutes"`
+	// Persist historical observations and metadata across restarts
+	DiskCache bool `json:"diskCache"`
+	// Size cap of the cache file in megabytes
+	DiskCacheMaxMb int `json:"diskCacheMaxMb"`
+	// Hours after which observations are considered immutable
+	DiskCacheAgeHours int `json:"diskCacheAgeHours"`
+	// Seconds between polls for new observations on live channels
+	StreamInterval int `json:"streamInterval"`
+	// Optional SensorThings MQTT broker, like ssl://broker:8883
+	MqttBrokerUrl string `json:"mqttBrokerUrl"`
+	// Topic prefix before Datastreams(id)/Observations
+	MqttTopicPrefix string `json:"mqttTopicPrefix"`
+	// Broker username, with the password kept in secrets
+	MqttUsername string `json:"mqttUsername"`
+	// Skip verification of the broker certificate
+	MqttTlsSkipVerify bool `json:"mqttTlsSkipVerify"`
+	// Upstream requests per second, unlimited when zero
+	RateLimit float64 `json:"rateLimit"`
+	// Requests allowed in a burst above the rate
+	RateLimitBurst int `json:"rateLimitBurst"`
+	// Attempts per upstream request including the first, 1 to disable retries
+	RetryAttempts int `json:"retryAttempts"`
+	// Longest backoff between attempts in milliseconds
+	RetryMaxDelayMs int `json:"retryMaxDelayMs"`
+	// Seconds allowed to establish a connection
+	ConnectTimeout int `json:"connectTimeout"`
+	// Seconds allowed for response headers after sending a request
+	ReadTimeout int `json:"readTimeout"`
+	// Seconds allowed for an upstream request including retries
+	RequestTimeout int `json:"requestTimeout"`
+	// Present a client certificate, kept in secrets
+	TlsAuth bool `json:"tlsAuth"`
+	// Verify the server against the CA certificate kept in secrets
+	TlsAuthWithCaCert bool `json:"tlsAuthWithCACert"`
+	// Verbosity of backend logs: debug, info, warn or error
+	LogLevel string                `json:"logLevel"`
+	Secrets  *SecretPluginSettings `json:"-"`
 }
 
 // Secrets set in plugin configuration.
 type SecretPluginSettings struct {
 	SecretKey string `json:"secretKey"`
 	ClientId  string `json:"clientId"`
+	// Password for the MQTT broker
+	MqttPassword string `json:"mqttPassword"`
+	// PEM encoded CA certificate for the MQTT broker
+	MqttCaCert string `json:"mqttCaCert"`
+	// PEM encoded CA certificate for the API server
+	TlsCaCert string `json:"tlsCACert"`
+	// PEM encoded client certificate and key for mutual TLS
+	TlsClientCert string `json:"tlsClientCert"`
+	TlsClientKey  string `json:"tlsClientKey"`
 }
 
 // Used in datasource initialization to load
 // the plugin settings from the datasource instance settings.
+// Settings are normalized, and returned along with ValidationErrors
+// when they cannot be used, so that the datasource can report them.
 func LoadPluginSettings(source backend.DataSourceInstanceSettings) (*PluginSettings, error) {
+	settings, err := decodePluginSettings(source)
+	if err != nil {
+		return nil, err
+	}
+	return settings, settings.Validate()
+}
+
+// Check settings that are about to be saved. Secrets are only
+// checked when present, since unchanged ones may be left out.
+func CheckPluginSettings(source backend.DataSourceInstanceSettings) error {
+	settings, err := decodePluginSettings(source)
+	if err != nil {
+		return err
+	}
+	return settings.validate(false)
+}
+
+// Normalized settings from the datasource instance settings.
+func decodePluginSettings(source backend.DataSourceInstanceSettings) (*PluginSettings, error) {
 	settings := PluginSettings{}
 	err := json.Unmarshal(source.JSONData, &settings)
 	if err != nil {
 		return nil, fmt.Errorf("could not unmarshal PluginSettings json: %w", err)
 	}
 	settings.Secrets = loadSecretPluginSettings(source.DecryptedSecureJSONData)
+	settings.normalize()
 	return &settings, nil
 }
 
 // Convert unstructured source map to SecretPluginSettings.
 func loadSecretPluginSettings(source map[string]string) *SecretPluginSettings {
 	return &SecretPluginSettings{
-		SecretKey: source["secretKey"],
-		ClientId:  source["clientId"],
+		SecretKey:     source["secretKey"],
+		ClientId:      source["clientId"],
+		MqttPassword:  source["mqttPassword"],
+		MqttCaCert:    source["mqttCaCert"],
+		TlsCaCert:     source["tlsCACert"],
+		TlsClientCert: source["tlsClientCert"],
+		TlsClientKey:  source["tlsClientKey"],
 	}
 }
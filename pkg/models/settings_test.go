@@ -0,0 +1,74 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Instance settings with valid secrets and the given JSON settings.
+func instanceSettings(jsonData string) backend.DataSourceInstanceSettings {
+	return backend.DataSourceInstanceSettings{
+		JSONData: []byte(jsonData),
+		DecryptedSecureJSONData: map[string]string{
+			"secretKey": " c2VjcmV0 ",
+			"clientId":  "client",
+		},
+	}
+}
+
+func TestLoadPluginSettingsNormalizes(t *testing.T) {
+	settings, err := LoadPluginSettings(instanceSettings(`{"serverUrl": "https://cloud.xylem.com/", "basePath": "xcloud//data-export/", "authMethod": " xCloud ", "mqttTopicPrefix": " /v1.1/ "}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.ServerUrl != "https://cloud.xylem.com" || settings.BasePath != "/xcloud/data-export" || settings.AuthMethod != "xCloud" {
+		t.Fatal("settings =", settings.ServerUrl, settings.BasePath, settings.AuthMethod)
+	}
+	if settings.MqttTopicPrefix != "v1.1" {
+		t.Fatal("topic prefix =", settings.MqttTopicPrefix)
+	}
+	if settings.Secrets.SecretKey != "c2VjcmV0" {
+		t.Fatal("secret key =", settings.Secrets.SecretKey)
+	}
+}
+
+func TestLoadPluginSettingsRejectsInvalid(t *testing.T) {
+	source := instanceSettings(`{"serverUrl": "cloud.xylem.com/xcloud", "basePath": "/xcloud?page=1", "authMethod": "x Cloud", "retryAttempts": -1, "mqttTopicPrefix": "v1.1/#"}`)
+	source.DecryptedSecureJSONData["secretKey"] = "not base64!"
+	settings, err := LoadPluginSettings(source)
+	if settings == nil {
+		t.Fatal("settings should be returned with the validation errors")
+	}
+	var invalid ValidationErrors
+	if !errors.As(err, &invalid) {
+		t.Fatal("expected validation errors, got", err)
+	}
+	fields := map[string]bool{}
+	for _, e := range invalid {
+		fields[e.Field] = true
+	}
+	for _, field := range []string{"serverUrl", "basePath", "authMethod", "secretKey", "retryAttempts", "mqttTopicPrefix"} {
+		if !fields[field] {
+			t.Error("expected", field, "to be rejected, got", err)
+		}
+	}
+}
+
+func TestServerUrlWithPath(t *testing.T) {
+	_, err := LoadPluginSettings(instanceSettings(`{"serverUrl": "https://cloud.xylem.com/xcloud", "authMethod": "xCloud"}`))
+	if err == nil || err.Error() != `serverUrl must not include a path, set basePath to "/xcloud" instead` {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckPluginSettingsWithoutSecrets(t *testing.T) {
+	source := backend.DataSourceInstanceSettings{JSONData: []byte(`{"serverUrl": "https://cloud.xylem.com", "authMethod": "xCloud"}`)}
+	if err := CheckPluginSettings(source); err != nil {
+		t.Fatal("unchanged secrets should not be required when saving,", err)
+	}
+	if _, err := LoadPluginSettings(source); err == nil {
+		t.Fatal("secrets should be required when loading")
+	}
+}
@@ -0,0 +1,151 @@
+package models
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Token allowed as an HTTP authentication scheme, which is sent before the
+// credentials in the Authorization header.
+var authMethodPattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// Verbosities understood by the backend logger.
+var logLevels = map[string]bool{"": true, "debug": true, "info": true, "warn": true, "warning": true, "error": true}
+
+// Setting that cannot be used, named by its JSON key.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// Every setting that cannot be used.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Tidy values that are easy to get slightly wrong: surrounding whitespace,
+// a trailing slash on the server URL, the slashes of the base path, which
+// always starts with one and never ends with one, and the slashes around
+// the topic prefix.
+func (s *PluginSettings) normalize() {
+	s.ServerUrl = strings.TrimRight(strings.TrimSpace(s.ServerUrl), "/")
+	s.BasePath = strings.TrimSpace(s.BasePath)
+	if s.BasePath != "" {
+		s.BasePath = strings.TrimSuffix(path.Clean("/"+s.BasePath), "/")
+	}
+	s.AuthMethod = strings.TrimSpace(s.AuthMethod)
+	s.MqttBrokerUrl = strings.TrimSpace(s.MqttBrokerUrl)
+	s.MqttTopicPrefix = strings.Trim(strings.TrimSpace(s.MqttTopicPrefix), "/")
+	if s.Secrets != nil {
+		s.Secrets.SecretKey = strings.TrimSpace(s.Secrets.SecretKey)
+		s.Secrets.ClientId = strings.TrimSpace(s.Secrets.ClientId)
+	}
+}
+
+// Check normalized settings, returning ValidationErrors for every problem.
+// An empty base path means the API is at the root of the server.
+func (s *PluginSettings) Validate() error {
+	return s.validate(true)
+}
+
+// Check normalized settings. Secrets are only checked when required or
+// present, since Grafana leaves unchanged secure values out of some requests.
+func (s *PluginSettings) validate(requireSecrets bool) error {
+	var errs ValidationErrors
+	invalid := func(field string, format string, args ...any) {
+		errs = append(errs, &ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	if s.ServerUrl == "" {
+		invalid("serverUrl", "is missing")
+	} else if server, err := url.Parse(s.ServerUrl); err != nil || (server.Scheme != "http" && server.Scheme != "https") || server.Host == "" {
+		invalid("serverUrl", "must be an absolute http or https URL")
+	} else if server.User != nil || server.RawQuery != "" || server.Fragment != "" {
+		invalid("serverUrl", "must not include credentials, a query or a fragment")
+	} else if server.Path != "" {
+		invalid("serverUrl", "must not include a path, set basePath to %q instead", server.Path)
+	}
+	if strings.ContainsAny(s.BasePath, "?#") {
+		invalid("basePath", "must not include a query or a fragment")
+	}
+	if s.AuthMethod == "" {
+		invalid("authMethod", "is missing")
+	} else if !authMethodPattern.MatchString(s.AuthMethod) {
+		invalid("authMethod", "must be a single word such as the scheme name, got %q", s.AuthMethod)
+	}
+	secrets := s.Secrets
+	if secrets == nil {
+		secrets = &SecretPluginSettings{}
+	}
+	if secrets.SecretKey == "" {
+		if requireSecrets {
+			invalid("secretKey", "is missing")
+		}
+	} else if key, err := base64.StdEncoding.DecodeString(secrets.SecretKey); err != nil || len(key) == 0 {
+		invalid("secretKey", "must be base64 encoded")
+	}
+	if secrets.ClientId == "" && requireSecrets {
+		invalid("clientId", "is missing")
+	}
+	if s.MqttBrokerUrl != "" {
+		if broker, err := url.Parse(s.MqttBrokerUrl); err != nil || broker.Scheme == "" || broker.Host == "" {
+			invalid("mqttBrokerUrl", "must be a URL like ssl://broker:8883")
+		}
+	}
+	if strings.ContainsAny(s.MqttTopicPrefix, "+#\x00") {
+		invalid("mqttTopicPrefix", "must not include the wildcards + or #")
+	}
+	if !logLevels[strings.ToLower(s.LogLevel)] {
+		invalid("logLevel", "must be one of debug, info, warn or error")
+	}
+	if s.RateLimit < 0 {
+		invalid("rateLimit", "must not be negative")
+	}
+	for _, setting := range []struct {
+		field string
+		value int
+	}{
+		{"resourceConcurrency", s.ResourceConcurrency},
+		{"queryConcurrency", s.QueryConcurrency},
+		{"observationSettleMinutes", s.ObservationSettleMinutes},
+		{"diskCacheMaxMb", s.DiskCacheMaxMb},
+		{"diskCacheAgeHours", s.DiskCacheAgeHours},
+		{"streamInterval", s.StreamInterval},
+		{"rateLimitBurst", s.RateLimitBurst},
+		{"retryAttempts", s.RetryAttempts},
+		{"retryMaxDelayMs", s.RetryMaxDelayMs},
+		{"connectTimeout", s.ConnectTimeout},
+		{"readTimeout", s.ReadTimeout},
+		{"requestTimeout", s.RequestTimeout},
+	} {
+		if setting.value < 0 {
+			invalid(setting.field, "must not be negative")
+		}
+	}
+	if requireSecrets && s.TlsAuth && secrets.TlsClientCert == "" {
+		invalid("tlsClientCert", "is required for TLS client authentication")
+	}
+	if requireSecrets && s.TlsAuth && secrets.TlsClientKey == "" {
+		invalid("tlsClientKey", "is required for TLS client authentication")
+	}
+	if requireSecrets && s.TlsAuthWithCaCert && secrets.TlsCaCert == "" {
+		invalid("tlsCACert", "is required to verify the server with a CA certificate")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
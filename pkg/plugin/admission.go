@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Kind of the objects checked on admission, raw datasource instance settings.
+const ADMISSION_KIND = "DataSourceInstanceSettings"
+
+// Checks datasource settings before Grafana saves them, so a configuration
+// that cannot be used is rejected with the settings at fault.
+type SettingsAdmission struct{}
+
+var _ backend.AdmissionHandler = SettingsAdmission{}
+
+// Reject settings that fail validation.
+func (SettingsAdmission) ValidateAdmission(ctx context.Context, req *backend.AdmissionRequest) (*backend.ValidationResponse, error) {
+	result, warnings, err := checkAdmission(req)
+	if err != nil {
+		return nil, err
+	}
+	return &backend.ValidationResponse{Allowed: result == nil, Result: result, Warnings: warnings}, nil
+}
+
+// Reject settings that fail validation, leaving valid ones unchanged, since
+// they are normalized when loaded.
+func (SettingsAdmission) MutateAdmission(ctx context.Context, req *backend.AdmissionRequest) (*backend.MutationResponse, error) {
+	result, warnings, err := checkAdmission(req)
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		return &backend.MutationResponse{Allowed: false, Result: result, Warnings: warnings}, nil
+	}
+	return &backend.MutationResponse{Allowed: true, ObjectBytes: req.ObjectBytes}, nil
+}
+
+// Failure status and one warning per invalid setting, or a nil status when
+// the settings in the request can be saved.
+func checkAdmission(req *backend.AdmissionRequest) (*backend.StatusResult, []string, error) {
+	if req.Kind.Kind != ADMISSION_KIND {
+		return nil, nil, fmt.Errorf("unsupported kind %q", req.Kind.Kind)
+	}
+	settings, err := backend.DataSourceInstanceSettingsFromProto(req.ObjectBytes, req.PluginContext.PluginID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding settings: %w", err)
+	}
+	if settings == nil {
+		return invalidSettings("settings are missing"), nil, nil
+	}
+	err = models.CheckPluginSettings(*settings)
+	var invalid models.ValidationErrors
+	switch {
+	case errors.As(err, &invalid):
+		warnings := make([]string, len(invalid))
+		for i, e := range invalid {
+			warnings[i] = e.Error()
+		}
+		return invalidSettings(err.Error()), warnings, nil
+	case err != nil:
+		return invalidSettings(err.Error()), nil, nil
+	}
+	return nil, nil, nil
+}
+
+func invalidSettings(message string) *backend.StatusResult {
+	return &backend.StatusResult{
+		Status:  "Failure",
+		Message: message,
+		Reason:  "Invalid",
+		Code:    http.StatusBadRequest,
+	}
+}
@@ -0,0 +1,47 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Admission request for saving datasource settings.
+func admissionRequest(t *testing.T, jsonData string) *backend.AdmissionRequest {
+	settings := &backend.DataSourceInstanceSettings{JSONData: []byte(jsonData)}
+	body, err := backend.DataSourceInstanceSettingsToProtoBytes(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &backend.AdmissionRequest{
+		Operation:   backend.AdmissionRequestUpdate,
+		Kind:        settings.GVK(),
+		ObjectBytes: body,
+	}
+}
+
+func TestValidateAdmission(t *testing.T) {
+	res, err := SettingsAdmission{}.ValidateAdmission(context.Background(), admissionRequest(t, `{"serverUrl": "https://cloud.xylem.com", "basePath": "/xcloud", "authMethod": "xCloud"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Allowed {
+		t.Fatal("valid settings rejected:", res.Result.Message)
+	}
+	res, err = SettingsAdmission{}.ValidateAdmission(context.Background(), admissionRequest(t, `{"serverUrl": "ftp://cloud.xylem.com", "authMethod": "xCloud"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Allowed || res.Result.Code != 400 || len(res.Warnings) != 1 {
+		t.Fatal("invalid settings allowed:", res)
+	}
+}
+
+func TestMutateAdmissionRejectsUnknownKind(t *testing.T) {
+	req := admissionRequest(t, `{}`)
+	req.Kind.Kind = "Dashboard"
+	if _, err := (SettingsAdmission{}).MutateAdmission(context.Background(), req); err == nil {
+		t.Fatal("expected an error for an unsupported kind")
+	}
+}
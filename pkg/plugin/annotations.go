@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Query type for annotations from an event or status datastream.
+const QUERY_TYPE_ANNOTATIONS = "annotations"
+
+// Maps an observed value or range of values to annotation text.
+// A rule with Value set matches that code exactly, otherwise the
+// value must fall within the optional Min and Max bounds.
+type AnnotationRule struct {
+	Value *float64 `json:"value"`
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+	Text  string   `json:"text"`
+	Tags  []string `json:"tags"`
+}
+
+// Whether the rule applies to an observed value.
+func (r AnnotationRule) matches(v float64) bool {
+	if r.Value != nil {
+		return v == *r.Value
+	}
+	if r.Min != nil && v < *r.Min {
+		return false
+	}
+	if r.Max != nil && v > *r.Max {
+		return false
+	}
+	return true
+}
+
+// Index of the first rule matching a value, or -1.
+func matchRule(rules []AnnotationRule, v float64) int {
+	for i, rule := range rules {
+		if rule.matches(v) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Convert observations of one datastream into annotation frames. Without
+// rules every observation becomes a marker with its value as text. With
+// rules, unmatched values are skipped, and repeated matches of the same rule
+// are collapsed into a region when only changes are requested.
+func annotationResponse(qm QueryModel, lookup map[string]string, series map[string][]models.Observation) backend.DataResponse {
+	var response backend.DataResponse
+	if qm.DataStreamId == "" {
+		return backend.ErrDataResponseWithSource(backend.StatusBadRequest, backend.ErrorSourceDownstream, "annotations require a datastream")
+	}
+	if err := validateRules(qm.Rules); err != nil {
+		return backend.ErrDataResponseWithSource(backend.StatusBadRequest, backend.ErrorSourceDownstream, fmt.Sprintf("rules: %v", err.Error()))
+	}
+	name := lookup[qm.DataStreamId]
+	sorted := sortedObservations(series[qm.DataStreamId])
+
+	var times, timeEnds []time.Time
+	var texts, tags []string
+	previous := -1
+	for _, observation := range sorted {
+		t := time.UnixMilli(observation.PhenomenonTime)
+		text := name + ": " + strconv.FormatFloat(observation.Value, 'f', -1, 64)
+		tag := []string{name}
+		rule := -1
+		if len(qm.Rules) > 0 {
+			rule = matchRule(qm.Rules, observation.Value)
+			if rule < 0 {
+				previous = -1
+				continue
+			}
+			if qm.ChangesOnly && rule == previous {
+				timeEnds[len(timeEnds)-1] = t
+				continue
+			}
+			text = qm.Rules[rule].Text
+			tag = append(tag, qm.Rules[rule].Tags...)
+		}
+		previous = rule
+		times = append(times, t)
+		timeEnds = append(timeEnds, t)
+		texts = append(texts, text)
+		tags = append(tags, strings.Join(tag, ","))
+	}
+	response.Frames = append(response.Frames, newAnnotationFrame("annotations", times, timeEnds, texts, tags))
+	return response
+}
+
+// Reject rules that can never match.
+func validateRules(rules []AnnotationRule) error {
+	for i, rule := range rules {
+		if rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+			return fmt.Errorf("rule %d: min is greater than max", i)
+		}
+	}
+	return nil
+}
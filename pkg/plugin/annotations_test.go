@@ -0,0 +1,45 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+func TestAnnotationRulesChangesOnly(t *testing.T) {
+	deployed, calibrating := 1.0, 2.0
+	series := map[string][]models.Observation{
+		"9": {
+			{Value: 1, PhenomenonTime: minute(0)},
+			{Value: 1, PhenomenonTime: minute(10)},
+			{Value: 0, PhenomenonTime: minute(20)},
+			{Value: 2, PhenomenonTime: minute(30)},
+		},
+	}
+	qm := QueryModel{
+		DataStreamId: "9",
+		ChangesOnly:  true,
+		Rules: []AnnotationRule{
+			{Value: &deployed, Text: "Deployed", Tags: []string{"deployment"}},
+			{Value: &calibrating, Text: "Calibration"},
+		},
+	}
+	resp := annotationResponse(qm, map[string]string{"9": "Status"}, series)
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	frame := resp.Frames[0]
+	if frame.Rows() != 2 {
+		t.Fatal("annotation rows =", frame.Rows())
+	}
+	if text := frame.Fields[2].At(0).(string); text != "Deployed" {
+		t.Fatal("text =", text)
+	}
+	if tags := frame.Fields[3].At(0).(string); tags != "Status,deployment" {
+		t.Fatal("tags =", tags)
+	}
+	if end := frame.Fields[1].At(0).(time.Time); end.UnixMilli() != minute(10) {
+		t.Fatal("region end =", end)
+	}
+}
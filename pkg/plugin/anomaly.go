@@ -0,0 +1,256 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Query type for spike and dropout detection.
+const QUERY_TYPE_ANOMALY = "anomaly"
+
+// Detection methods that can be enabled in an anomaly query.
+const (
+	METHOD_ZSCORE   = "zscore"
+	METHOD_HAMPEL   = "hampel"
+	METHOD_FLATLINE = "flatline"
+	METHOD_RATE     = "rate"
+)
+
+// Scale factor relating median absolute deviation to standard deviation
+// for normally distributed data.
+const MAD_SCALE = 1.4826
+
+// Detector options selected in the query editor. Zero values fall
+// back to the defaults applied in withDefaults.
+type DetectorModel struct {
+	// Methods to run, all except rate when empty
+	Methods []string `json:"methods"`
+	// Number of samples in the rolling window
+	Window int `json:"window"`
+	// Standard deviations from the rolling mean to flag
+	ZScore float64 `json:"zScore"`
+	// Scaled deviations from the rolling median to flag
+	HampelK float64 `json:"hampelK"`
+	// Minimum run of identical samples counted as a flat line
+	FlatLine int `json:"flatLine"`
+	// Largest allowed change in value per second
+	MaxRate float64 `json:"maxRate"`
+	// Remove flagged points from the returned series
+	Mask bool `json:"mask"`
+}
+
+// Fill in defaults for unset detector options.
+func (m DetectorModel) withDefaults() DetectorModel {
+	if len(m.Methods) == 0 {
+		m.Methods = []string{METHOD_ZSCORE, METHOD_HAMPEL, METHOD_FLATLINE}
+	}
+	if m.Window <= 1 {
+		m.Window = 11
+	}
+	if m.ZScore <= 0 {
+		m.ZScore = 3
+	}
+	if m.HampelK <= 0 {
+		m.HampelK = 3
+	}
+	if m.FlatLine <= 1 {
+		m.FlatLine = 6
+	}
+	return m
+}
+
+// Points flagged by one detection method. First and Last are indices
+// into the sorted observations, so regions such as flat lines span
+// more than one sample.
+type anomaly struct {
+	Method string
+	First  int
+	Last   int
+	Value  float64
+}
+
+// Flag points further than limit standard deviations from the mean of
+// the preceding window.
+func rollingZScore(obs []models.Observation, window int, limit float64) []anomaly {
+	var result []anomaly
+	for i := window; i < len(obs); i++ {
+		sum, squares := 0.0, 0.0
+		for _, o := range obs[i-window : i] {
+			sum += o.Value
+			squares += o.Value * o.Value
+		}
+		mean := sum / float64(window)
+		std := math.Sqrt(math.Max(squares/float64(window)-mean*mean, 0))
+		if std == 0 {
+			continue
+		}
+		if math.Abs(obs[i].Value-mean)/std > limit {
+			result = append(result, anomaly{Method: METHOD_ZSCORE, First: i, Last: i, Value: obs[i].Value})
+		}
+	}
+	return result
+}
+
+// Median of values, reordering them in place.
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// Hampel filter: flag points further than k scaled median absolute
+// deviations from the median of a centered window.
+func hampel(obs []models.Observation, window int, k float64) []anomaly {
+	var result []anomaly
+	half := window / 2
+	values := make([]float64, 0, window)
+	for i := range obs {
+		lo, hi := max(i-half, 0), min(i+half+1, len(obs))
+		values = values[:0]
+		for _, o := range obs[lo:hi] {
+			values = append(values, o.Value)
+		}
+		center := median(values)
+		for j := range values {
+			values[j] = math.Abs(values[j] - center)
+		}
+		mad := MAD_SCALE * median(values)
+		if mad == 0 {
+			continue
+		}
+		if math.Abs(obs[i].Value-center) > k*mad {
+			result = append(result, anomaly{Method: METHOD_HAMPEL, First: i, Last: i, Value: obs[i].Value})
+		}
+	}
+	return result
+}
+
+// Flag runs of at least minimum consecutive identical values.
+func flatLines(obs []models.Observation, minimum int) []anomaly {
+	var result []anomaly
+	first := 0
+	for i := 1; i <= len(obs); i++ {
+		if i < len(obs) && obs[i].Value == obs[first].Value {
+			continue
+		}
+		if i-first >= minimum {
+			result = append(result, anomaly{Method: METHOD_FLATLINE, First: first, Last: i - 1, Value: obs[first].Value})
+		}
+		first = i
+	}
+	return result
+}
+
+// Flag points that changed faster than maxRate units per second
+// since the previous sample.
+func rateOfChange(obs []models.Observation, maxRate float64) []anomaly {
+	var result []anomaly
+	for i := 1; i < len(obs); i++ {
+		seconds := float64(obs[i].PhenomenonTime-obs[i-1].PhenomenonTime) / 1000
+		if seconds <= 0 {
+			continue
+		}
+		if math.Abs(obs[i].Value-obs[i-1].Value)/seconds > maxRate {
+			result = append(result, anomaly{Method: METHOD_RATE, First: i, Last: i, Value: obs[i].Value})
+		}
+	}
+	return result
+}
+
+// Run the selected detectors over observations sorted by time.
+func detect(obs []models.Observation, m DetectorModel) ([]anomaly, error) {
+	var result []anomaly
+	for _, method := range m.Methods {
+		switch method {
+		case METHOD_ZSCORE:
+			result = append(result, rollingZScore(obs, m.Window, m.ZScore)...)
+		case METHOD_HAMPEL:
+			result = append(result, hampel(obs, m.Window, m.HampelK)...)
+		case METHOD_FLATLINE:
+			result = append(result, flatLines(obs, m.FlatLine)...)
+		case METHOD_RATE:
+			if m.MaxRate <= 0 {
+				return nil, fmt.Errorf("rate detection requires maxRate")
+			}
+			result = append(result, rateOfChange(obs, m.MaxRate)...)
+		default:
+			return nil, fmt.Errorf("unknown detection method %q", method)
+		}
+	}
+	return result, nil
+}
+
+// Frame in the shape Grafana reads annotations from. Tags are
+// comma separated.
+func newAnnotationFrame(name string, times []time.Time, timeEnds []time.Time, texts []string, tags []string) *data.Frame {
+	frame := data.NewFrame(name,
+		data.NewField("time", nil, times),
+		data.NewField("timeEnd", nil, timeEnds),
+		data.NewField("text", nil, texts),
+		data.NewField("tags", nil, tags),
+	)
+	frame.SetMeta(&data.FrameMeta{DataTopic: data.DataTopicAnnotations})
+	return frame
+}
+
+// Detect anomalies in each datastream, returning the series, with flagged
+// points removed when masking, and an annotation frame of flagged points.
+func anomalyResponse(qm QueryModel, lookup map[string]string, series map[string][]models.Observation) backend.DataResponse {
+	detector := qm.Detector.withDefaults()
+	ids := make([]string, 0, len(series))
+	for k := range series {
+		if qm.DataStreamId == "" || qm.DataStreamId == k {
+			ids = append(ids, k)
+		}
+	}
+	sort.Strings(ids)
+
+	output := make(map[string][]models.Observation, len(ids))
+	var times, timeEnds []time.Time
+	var texts, tags []string
+	for _, id := range ids {
+		sorted := sortedObservations(series[id])
+		anomalies, err := detect(sorted, detector)
+		if err != nil {
+			return backend.ErrDataResponseWithSource(backend.StatusBadRequest, backend.ErrorSourceDownstream, fmt.Sprintf("detector: %v", err.Error()))
+		}
+		sort.SliceStable(anomalies, func(i, j int) bool {
+			return anomalies[i].First < anomalies[j].First
+		})
+		flagged := make([]bool, len(sorted))
+		for _, a := range anomalies {
+			for i := a.First; i <= a.Last; i++ {
+				flagged[i] = true
+			}
+			times = append(times, time.UnixMilli(sorted[a.First].PhenomenonTime))
+			timeEnds = append(timeEnds, time.UnixMilli(sorted[a.Last].PhenomenonTime))
+			texts = append(texts, fmt.Sprintf("%s: %s anomaly at %v", lookup[id], a.Method, a.Value))
+			tags = append(tags, strings.Join([]string{"anomaly", a.Method, lookup[id]}, ","))
+		}
+		if !detector.Mask {
+			output[id] = sorted
+			continue
+		}
+		kept := make([]models.Observation, 0, len(sorted))
+		for i, o := range sorted {
+			if !flagged[i] {
+				kept = append(kept, o)
+			}
+		}
+		output[id] = kept
+	}
+	response := timeSeriesResponse(qm.ThingId, lookup, output)
+	response.Frames = append(response.Frames, newAnnotationFrame("anomalies", times, timeEnds, texts, tags))
+	return response
+}
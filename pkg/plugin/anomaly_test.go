@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Gently varying series with a single spike at index 15
+func spikeSeries() []models.Observation {
+	obs := make([]models.Observation, 30)
+	for i := range obs {
+		obs[i] = models.Observation{Value: 10 + float64(i%3)*0.1, PhenomenonTime: minute(i)}
+	}
+	obs[15].Value = 40
+	return obs
+}
+
+func TestHampelSpike(t *testing.T) {
+	anomalies := hampel(spikeSeries(), 11, 3)
+	if len(anomalies) != 1 || anomalies[0].First != 15 {
+		t.Fatal("anomalies =", anomalies)
+	}
+}
+
+func TestRollingZScoreSpike(t *testing.T) {
+	anomalies := rollingZScore(spikeSeries(), 11, 3)
+	if len(anomalies) == 0 || anomalies[0].First != 15 {
+		t.Fatal("anomalies =", anomalies)
+	}
+}
+
+func TestFlatLines(t *testing.T) {
+	obs := spikeSeries()
+	for i := 20; i < 28; i++ {
+		obs[i].Value = 7
+	}
+	anomalies := flatLines(obs, 6)
+	if len(anomalies) != 1 || anomalies[0].First != 20 || anomalies[0].Last != 27 {
+		t.Fatal("anomalies =", anomalies)
+	}
+}
+
+func TestAnomalyResponseMask(t *testing.T) {
+	series := map[string][]models.Observation{"1": spikeSeries()}
+	qm := QueryModel{Detector: DetectorModel{Methods: []string{METHOD_HAMPEL}, Mask: true}}
+	resp := anomalyResponse(qm, map[string]string{"1": "Conductivity"}, series)
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if len(resp.Frames) != 2 {
+		t.Fatal("frame count =", len(resp.Frames))
+	}
+	if rows := resp.Frames[0].Rows(); rows != 29 {
+		t.Fatal("masked series rows =", rows)
+	}
+	if rows := resp.Frames[1].Rows(); rows != 1 {
+		t.Fatal("annotation rows =", rows)
+	}
+	bad := anomalyResponse(QueryModel{Detector: DetectorModel{Methods: []string{"magic"}}}, nil, series)
+	if bad.Error == nil {
+		t.Fatal("unknown method accepted")
+	}
+}
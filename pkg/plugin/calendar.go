@@ -0,0 +1,181 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Query type for calendar aggregation tables.
+const QUERY_TYPE_CALENDAR = "calendar"
+
+// Calendar bucket sizes accepted by aggregate queries.
+const (
+	INTERVAL_HOUR  = "hour"
+	INTERVAL_DAY   = "day"
+	INTERVAL_WEEK  = "week"
+	INTERVAL_MONTH = "month"
+	INTERVAL_YEAR  = "year"
+)
+
+// Percentiles reported when the query does not select any.
+var DEFAULT_PERCENTILES = []float64{50}
+
+// Observation values that fall within one calendar bucket.
+type calendarBucket struct {
+	Start  time.Time
+	Values []float64
+}
+
+// Truncate a time to the start of its calendar bucket in the given location.
+// Weeks start on Monday, following ISO 8601.
+func bucketStart(t time.Time, interval string, loc *time.Location) (time.Time, error) {
+	t = t.In(loc)
+	year, month, day := t.Date()
+	switch interval {
+	case INTERVAL_HOUR:
+		return time.Date(year, month, day, t.Hour(), 0, 0, 0, loc), nil
+	case INTERVAL_DAY:
+		return time.Date(year, month, day, 0, 0, 0, 0, loc), nil
+	case INTERVAL_WEEK:
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-offset, 0, 0, 0, 0, loc), nil
+	case INTERVAL_MONTH:
+		return time.Date(year, month, 1, 0, 0, 0, 0, loc), nil
+	case INTERVAL_YEAR:
+		return time.Date(year, time.January, 1, 0, 0, 0, 0, loc), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown interval %q", interval)
+}
+
+// Group observations into calendar buckets, ordered by bucket start.
+func calendarBuckets(obs []models.Observation, interval string, loc *time.Location) ([]calendarBucket, error) {
+	index := make(map[int64]int)
+	var buckets []calendarBucket
+	for _, observation := range obs {
+		if math.IsNaN(observation.Value) {
+			continue
+		}
+		t := time.UnixMilli(observation.PhenomenonTime)
+		start, err := bucketStart(t, interval, loc)
+		if err != nil {
+			return nil, err
+		}
+		key := start.Unix()
+		i, ok := index[key]
+		if !ok {
+			i = len(buckets)
+			index[key] = i
+			buckets = append(buckets, calendarBucket{Start: start})
+		}
+		buckets[i].Values = append(buckets[i].Values, observation.Value)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Start.Before(buckets[j].Start)
+	})
+	return buckets, nil
+}
+
+// Linear interpolation between closest ranks of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return sorted[lower]
+	}
+	return sorted[lower] + (rank-float64(lower))*(sorted[upper]-sorted[lower])
+}
+
+// Column name for a percentile, like p50 or p99.9.
+func percentileName(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// Build a table frame with one row per datastream and calendar bucket.
+func calendarResponse(qm QueryModel, lookup map[string]string, series map[string][]models.Observation) backend.DataResponse {
+	var response backend.DataResponse
+	interval := qm.Interval
+	if interval == "" {
+		interval = INTERVAL_DAY
+	}
+	timezone := qm.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return backend.ErrDataResponseWithSource(backend.StatusBadRequest, backend.ErrorSourceDownstream, fmt.Sprintf("timezone: %v", err.Error()))
+	}
+	percentiles := qm.Percentiles
+	if len(percentiles) == 0 {
+		percentiles = DEFAULT_PERCENTILES
+	}
+	for _, p := range percentiles {
+		if p < 0 || p > 100 || math.IsNaN(p) {
+			return backend.ErrDataResponseWithSource(backend.StatusBadRequest, backend.ErrorSourceDownstream, fmt.Sprintf("percentile out of range: %v", p))
+		}
+	}
+	ids := make([]string, 0, len(series))
+	for k := range series {
+		ids = append(ids, k)
+	}
+	sort.Strings(ids)
+
+	var names []string
+	var starts []time.Time
+	var counts []int64
+	var mins, maxs, means, sums []float64
+	quantiles := make([][]float64, len(percentiles))
+	for _, id := range ids {
+		buckets, err := calendarBuckets(series[id], interval, loc)
+		if err != nil {
+			return backend.ErrDataResponseWithSource(backend.StatusBadRequest, backend.ErrorSourceDownstream, fmt.Sprintf("interval: %v", err.Error()))
+		}
+		for _, bucket := range buckets {
+			values := bucket.Values
+			sort.Float64s(values)
+			sum := 0.0
+			for _, v := range values {
+				sum += v
+			}
+			names = append(names, lookup[id])
+			starts = append(starts, bucket.Start)
+			counts = append(counts, int64(len(values)))
+			mins = append(mins, values[0])
+			maxs = append(maxs, values[len(values)-1])
+			sums = append(sums, sum)
+			means = append(means, sum/float64(len(values)))
+			for i, p := range percentiles {
+				quantiles[i] = append(quantiles[i], percentile(values, p))
+			}
+		}
+	}
+	frame := data.NewFrame("calendar",
+		data.NewField("datastream", nil, names),
+		data.NewField("bucket", nil, starts),
+		data.NewField("count", nil, counts),
+		data.NewField("min", nil, mins),
+		data.NewField("max", nil, maxs),
+		data.NewField("mean", nil, means),
+		data.NewField("sum", nil, sums),
+	)
+	for i, p := range percentiles {
+		frame.Fields = append(frame.Fields, data.NewField(percentileName(p), nil, quantiles[i]))
+	}
+	frame.SetMeta(&data.FrameMeta{
+		PreferredVisualization: data.VisTypeTable,
+	})
+	response.Frames = append(response.Frames, frame)
+	return response
+}
@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Local days should not be split at UTC midnight
+func TestCalendarBucketsTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("timezone database unavailable:", err)
+	}
+	// 2025-06-01 23:30 and 2025-06-02 01:30 UTC are both 2025-06-01 local
+	obs := []models.Observation{
+		{Value: 1, PhenomenonTime: time.Date(2025, 6, 1, 23, 30, 0, 0, time.UTC).UnixMilli()},
+		{Value: 3, PhenomenonTime: time.Date(2025, 6, 2, 1, 30, 0, 0, time.UTC).UnixMilli()},
+		{Value: 5, PhenomenonTime: time.Date(2025, 6, 2, 12, 0, 0, 0, time.UTC).UnixMilli()},
+	}
+	buckets, err := calendarBuckets(obs, INTERVAL_DAY, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 {
+		t.Fatal("bucket count =", len(buckets))
+	}
+	if len(buckets[0].Values) != 2 || buckets[0].Start.Day() != 1 {
+		t.Fatal("first bucket =", buckets[0])
+	}
+}
+
+func TestBucketStartWeek(t *testing.T) {
+	// Sunday belongs to the week starting the previous Monday
+	sunday := time.Date(2025, 6, 8, 15, 0, 0, 0, time.UTC)
+	start, err := bucketStart(sunday, INTERVAL_WEEK, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start.Weekday() != time.Monday || start.Day() != 2 {
+		t.Fatal("week start =", start)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4}
+	if p := percentile(sorted, 50); p != 2.5 {
+		t.Fatal("p50 =", p)
+	}
+	if p := percentile(sorted, 100); p != 4 {
+		t.Fatal("p100 =", p)
+	}
+}
+
+func TestCalendarResponse(t *testing.T) {
+	series := map[string][]models.Observation{
+		"1": {
+			{Value: 2, PhenomenonTime: time.Date(2025, 1, 1, 1, 0, 0, 0, time.UTC).UnixMilli()},
+			{Value: 4, PhenomenonTime: time.Date(2025, 1, 1, 2, 0, 0, 0, time.UTC).UnixMilli()},
+		},
+	}
+	qm := QueryModel{Interval: INTERVAL_MONTH, Percentiles: []float64{50, 90}}
+	resp := calendarResponse(qm, map[string]string{"1": "Temperature"}, series)
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	frame := resp.Frames[0]
+	if len(frame.Fields) != 9 {
+		t.Fatal("field count =", len(frame.Fields))
+	}
+	if mean := frame.Fields[5].At(0).(float64); mean != 3 {
+		t.Fatal("mean =", mean)
+	}
+	bad := calendarResponse(QueryModel{Timezone: "Not/AZone"}, nil, series)
+	if bad.Error == nil {
+		t.Fatal("invalid timezone accepted")
+	}
+}
@@ -0,0 +1,60 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Time allowed to establish a connection, unless configured.
+const CONNECT_TIMEOUT = 10 * time.Second
+// Time allowed for response headers after sending a request, unless configured.
+const READ_TIMEOUT = 30 * time.Second
+// Time allowed for an upstream request including retries, unless configured.
+const REQUEST_TIMEOUT = 60 * time.Second
+
+// Upstream request abandoned after the overall timeout.
+var errRequestTimeout = errors.New("upstream request timed out")
+
+// Configured duration in seconds, or the default when unset.
+func seconds(configured int, fallback time.Duration) time.Duration {
+	if configured > 0 {
+		return time.Duration(configured) * time.Second
+	}
+	return fallback
+}
+
+// HTTP client built by the SDK from the datasource HTTP options, so that
+// proxies, custom CAs, client certificates and TLS server names configured
+// in Grafana apply. The connect and read timeouts come from the plugin
+// settings, and the overall timeout is applied to the context of each
+// request instead, so that it also bounds retries.
+func newHttpClient(ctx context.Context, instanceSettings backend.DataSourceInstanceSettings, config *models.PluginSettings) (*http.Client, error) {
+	opts, err := instanceSettings.HTTPClientOptions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("http client options: %w", err)
+	}
+	connect := seconds(config.ConnectTimeout, CONNECT_TIMEOUT)
+	read := seconds(config.ReadTimeout, READ_TIMEOUT)
+	opts.Timeouts.DialTimeout = connect
+	opts.Timeouts.TLSHandshakeTimeout = connect
+	opts.ConfigureTransport = func(_ httpclient.Options, transport *http.Transport) {
+		transport.ResponseHeaderTimeout = read
+	}
+	opts.ConfigureClient = func(_ httpclient.Options, client *http.Client) {
+		client.Timeout = 0
+	}
+	return httpclient.NewProvider().New(opts)
+}
+
+// Time allowed for an upstream request including retries.
+func (d *Datasource) requestTimeout() time.Duration {
+	return seconds(d.Config.RequestTimeout, REQUEST_TIMEOUT)
+}
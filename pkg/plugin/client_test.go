@@ -0,0 +1,136 @@
+package plugin
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+func TestCancelStopsUpstreamRequest(t *testing.T) {
+	aborted := make(chan struct{})
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := ds.get(ctx, "/api/things"); err == nil {
+		t.Fatal("expected cancellation error")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request should be aborted when the caller cancels")
+	}
+}
+
+func TestCancelStopsRetries(t *testing.T) {
+	var attempts atomic.Int32
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	ds.Config.RetryAttempts = 100
+	ds.Config.RetryMaxDelayMs = 10
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	ds.get(ctx, "/api/things")
+	time.Sleep(50 * time.Millisecond)
+	settled := attempts.Load()
+	time.Sleep(100 * time.Millisecond)
+	if attempts.Load() != settled {
+		t.Fatal("upstream retried after every caller left, attempts =", settled, attempts.Load())
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	ds.Config.RequestTimeout = 1
+	start := time.Now()
+	_, err := ds.get(context.Background(), "/api/things")
+	if !errors.Is(err, errRequestTimeout) {
+		t.Fatal("expected request timeout, got", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatal("request should give up after the overall timeout, took", elapsed)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	ds.Config.RetryAttempts = 1
+	ds.Config.ReadTimeout = 1
+	ds.Config.RequestTimeout = 10
+	client, err := newHttpClient(context.Background(), backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)}, ds.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Client = client
+	start := time.Now()
+	_, err = ds.get(context.Background(), "/api/things")
+	if err == nil || errors.Is(err, errRequestTimeout) {
+		t.Fatal("expected the read timeout to end the attempt, got", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatal("attempt should end after the read timeout, took", elapsed)
+	}
+}
+
+func TestClientTrustsConfiguredCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	config := &models.PluginSettings{
+		ServerUrl:     server.URL,
+		AuthMethod:    AUTH_METHOD,
+		RetryAttempts: 1,
+		Secrets: &models.SecretPluginSettings{
+			SecretKey: "c2VjcmV0",
+			ClientId:  "client",
+		},
+	}
+	for _, trusted := range []bool{false, true} {
+		settings := backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)}
+		if trusted {
+			settings.JSONData = []byte(`{"tlsAuthWithCACert": true}`)
+			settings.DecryptedSecureJSONData = map[string]string{"tlsCACert": string(ca)}
+		}
+		client, err := newHttpClient(context.Background(), settings, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds := &Datasource{Config: config, Client: client}
+		_, err = ds.get(context.Background(), "/api/things")
+		if trusted && err != nil {
+			t.Fatal("configured CA should be trusted:", err)
+		}
+		if !trusted && err == nil {
+			t.Fatal("self-signed server should not be trusted without the CA")
+		}
+	}
+}
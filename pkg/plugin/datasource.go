@@ -6,16 +6,27 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math"
 	"net/http"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
 )
@@ -36,6 +47,14 @@ const QUERY_TAGS = "datastreamIds"
 const QUERY_ROOT = "site"
 // Second path element for querying data streams.
 const QUERY_COLLECTION = "datastreams"
+// Datastream lookups in flight per resource call, unless configured.
+const RESOURCE_CONCURRENCY = 8
+// Resource path for purging cached metadata and observations with DELETE.
+const RESOURCE_CACHE = "cache"
+// Organization role allowed to purge the cache.
+const ROLE_ADMIN = "Admin"
+// Queries running at once per datasource instance, unless configured.
+const QUERY_CONCURRENCY = 8
 
 // Make sure Datasource implements required interfaces. This is important to do
 // since otherwise we will only get a not implemented error response from plugin in
@@ -45,6 +64,7 @@ const QUERY_COLLECTION = "datastreams"
 var (
 	_ backend.QueryDataHandler      = (*Datasource)(nil)
 	_ backend.CheckHealthHandler    = (*Datasource)(nil)
+	_ backend.StreamHandler         = (*Datasource)(nil)
 	_ instancemgmt.InstanceDisposer = (*Datasource)(nil)
 )
 
@@ -84,17 +104,18 @@ func authHeader(authMethod string, clientId string, hmac []byte) string {
 	return auth
 }
 
-// Produce a GET request with HMAC signature.
-func signedGetRequest(server string, path string, clientId string, secretKey string, authMethod string, delim string) (*http.Request, error) {
+// Produce a GET request with HMAC signature. The escaped path and query
+// are signed exactly as they are sent.
+func signedGetRequest(ctx context.Context, server string, path string, clientId string, secretKey string, authMethod string, delim string) (*http.Request, error) {
 	date := time.Now().UTC()
-	data := hmacStringArray(date, clientId, path)
-	hmac := signedHmacBytes(strings.Join(data, delim), secretKey)
-	auth := authHeader(authMethod, clientId, hmac)
 	url := server + path
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return req, err
 	}
+	data := hmacStringArray(date, clientId, req.URL.RequestURI())
+	hmac := signedHmacBytes(strings.Join(data, delim), secretKey)
+	auth := authHeader(authMethod, clientId, hmac)
 	isoDate := date.Format(ISO_COMPATIBILITY)
 	req.Header.Add("Authorization", auth)
 	req.Header.Add("Date", isoDate)
@@ -104,15 +125,42 @@ func signedGetRequest(server string, path string, clientId string, secretKey str
 // Construct an empty datasource instance. Called as Factory method in main.go
 // Can pass in the instance settings, which are used to configure the datasource,
 // so that secrets can be access from resource calls.
-func NewDatasource(_ context.Context, instanceSettings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+func NewDatasource(ctx context.Context, instanceSettings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
 	config, err := models.LoadPluginSettings(instanceSettings)
-	if err != nil {
+	// Unusable settings are reported by queries and health checks instead
+	var invalid models.ValidationErrors
+	if err != nil && !errors.As(err, &invalid) {
+		return nil, err
+	}
+	settingsErr := err
+	client, err := newHttpClient(ctx, instanceSettings, config)
+	if err != nil && settingsErr == nil {
 		return nil, err
 	}
-	return &Datasource{
-		Config: config,
-		Client: &http.Client{},
-	}, nil
+	concurrency := int64(config.QueryConcurrency)
+	if concurrency <= 0 {
+		concurrency = QUERY_CONCURRENCY
+	}
+	ds := &Datasource{
+		Config:           config,
+		Client:           client,
+		settingsErr:      settingsErr,
+		queries:          semaphore.NewWeighted(concurrency),
+		metadata:         newMetadataCache(config),
+		observationCache: newObservationCacheFromSettings(config),
+		limiter:          newTokenBucketFromSettings(config),
+		logger:           newPluginLogger(log.DefaultLogger, config),
+	}
+	if config.DiskCache {
+		// Caching only in memory is preferable to an unusable datasource
+		ds.diskStore, err = acquireDiskStore(config, instanceSettings.UID)
+		if err != nil {
+			ds.log(ctx).Warn("Disk cache unavailable, caching in memory only", "error", err)
+		} else if err = ds.loadMetadata(); err != nil {
+			ds.log(ctx).Warn("Restoring cached metadata from disk failed", "error", err)
+		}
+	}
+	return ds, nil
 }
 
 // Datasource is an example datasource which can respond to data queries, reports
@@ -120,6 +168,25 @@ func NewDatasource(_ context.Context, instanceSettings backend.DataSourceInstanc
 type Datasource struct{
 	Config *models.PluginSettings
 	Client *http.Client
+	// Why the settings cannot be used, when they cannot
+	settingsErr error
+	// Limits queries running at once across requests, unlimited when nil
+	queries *semaphore.Weighted
+	// Identical upstream requests in flight
+	inflight inflightRequests
+	// Paces upstream requests, unlimited when nil
+	limiter *tokenBucket
+	// Redacting logger at the configured verbosity
+	logger *pluginLogger
+	// Things and datastreams, without caching when nil
+	metadata *metadataCache
+	// Observations by covered time range, without caching when nil
+	observationCache *observationCache
+	// Persisted historical observations and metadata, when enabled
+	diskStore *diskStore
+	// Broker connection for live channels, created on first use
+	mqtt     *mqttHub
+	mqttLock sync.Mutex
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
@@ -127,6 +194,15 @@ type Datasource struct{
 // be disposed and a new one will be created using NewSampleDatasource factory function.
 func (d *Datasource) Dispose() {
 	// Clean up datasource instance resources.
+	d.metadata.purge()
+	d.observationCache.purge()
+	d.diskStore.release()
+	d.mqttLock.Lock()
+	defer d.mqttLock.Unlock()
+	if d.mqtt != nil {
+		d.mqtt.close()
+		d.mqtt = nil
+	}
 }
 
 // QueryData handles multiple queries and returns multiple responses.
@@ -134,121 +210,139 @@ func (d *Datasource) Dispose() {
 // The QueryDataResponse contains a map of RefID to the response for each query, and each response
 // contains Frames ([]*Frame).
 func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	ctx, span := startSpan(ctx, "QueryData", attribute.Int("hmac.query_count", len(req.Queries)))
+	defer span.End()
 
 	// create response struct
 	response := backend.NewQueryDataResponse()
+	if d.settingsErr != nil {
+		for _, q := range req.Queries {
+			response.Responses[q.RefID] = backend.ErrDataResponseWithSource(backend.StatusBadRequest, backend.ErrorSourceDownstream, d.invalidSettings().Error())
+		}
+		return response, nil
+	}
 
-	// loop over queries and execute them individually.
-	for _, q := range req.Queries {
-		res := d.query(ctx, req.PluginContext, q)
+	// run queries concurrently, sharing datastream lookups between them
+	lookups := newDataStreamLookups()
+	responses := make([]backend.DataResponse, len(req.Queries))
+	var wg sync.WaitGroup
+	for i, q := range req.Queries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if d.queries != nil {
+				// waiting for a query slot is the plugin's own limit, unless
+				// the caller gave up
+				if err := d.queries.Acquire(ctx, 1); err != nil {
+					status, source := classifyError(err)
+					if !errors.Is(err, context.Canceled) {
+						source = backend.ErrorSourcePlugin
+					}
+					responses[i] = backend.ErrDataResponseWithSource(status, source, err.Error())
+					return
+				}
+				defer d.queries.Release(1)
+			}
+			responses[i] = d.query(ctx, req.PluginContext, q, lookups)
+		}()
+	}
+	wg.Wait()
 
-		// save the response in a hashmap
-		// based on with RefID as identifier
-		response.Responses[q.RefID] = res
+	// save the response in a hashmap
+	// based on with RefID as identifier
+	for i, q := range req.Queries {
+		response.Responses[q.RefID] = responses[i]
 	}
 
 	return response, nil
 }
 
+// Datastream lookups shared by the queries of one request, so that
+// queries on the same thing fetch its datastreams once.
+type dataStreamLookups struct {
+	mu    sync.Mutex
+	calls map[string]*dataStreamLookup
+}
+
+// Result of looking up the datastreams of one thing.
+type dataStreamLookup struct {
+	once        sync.Once
+	dataStreams []models.DataStream
+	err         error
+}
+
+func newDataStreamLookups() *dataStreamLookups {
+	return &dataStreamLookups{calls: make(map[string]*dataStreamLookup)}
+}
+
+// Fetch the datastreams of a thing, or wait for the query already fetching them.
+func (l *dataStreamLookups) get(thingId string, fetch func(string) ([]models.DataStream, error)) ([]models.DataStream, error) {
+	l.mu.Lock()
+	call, ok := l.calls[thingId]
+	if !ok {
+		call = &dataStreamLookup{}
+		l.calls[thingId] = call
+	}
+	l.mu.Unlock()
+	call.once.Do(func() {
+		call.dataStreams, call.err = fetch(thingId)
+	})
+	return call.dataStreams, call.err
+}
+
 // Implement a generic resource handler for the datasource.
 // This will need a switch statement to handle different paths.
 func (d *Datasource) CallResource(
-	// Unused
-	_ context.Context,
+	// Cancels outstanding datastream lookups
+	ctx context.Context,
 	// Contains API path to query
 	req *backend.CallResourceRequest,
 	// Response handler
 	sender backend.CallResourceResponseSender,
 ) error {
-	path := d.Config.BasePath + "/" + req.Path
-	getReq, err := d.request(path)
-	if err != nil {
+	ctx, span := startSpan(ctx, "CallResource", attribute.String("hmac.resource_path", req.Path))
+	defer span.End()
+	if d.settingsErr != nil {
+		return sendResourceError(sender, http.StatusBadRequest, d.invalidSettings().Error())
+	}
+	switch req.Path {
+	case RESOURCE_CACHE:
+		if req.Method != http.MethodDelete {
+			return sendResourceError(sender, http.StatusMethodNotAllowed, "use DELETE to purge the cache")
+		}
+		if user := req.PluginContext.User; user == nil || user.Role != ROLE_ADMIN {
+			return sendResourceError(sender, http.StatusForbidden, "only organization admins can purge the cache")
+		}
+		d.metadata.purge()
+		d.observationCache.purge()
+		if err := d.diskStore.purge(); err != nil {
+			return sendResourceError(sender, http.StatusInternalServerError, err.Error())
+		}
 		return sender.Send(&backend.CallResourceResponse{
-			Status: http.StatusInternalServerError,
-			Body: []byte(err.Error()),
+			Status: http.StatusNoContent,
 		})
 	}
-	resp, err := d.Client.Do(getReq)
+	segments, err := resourceSegments(req.Path)
 	if err != nil {
-		return sender.Send(&backend.CallResourceResponse{
-			Status: http.StatusInternalServerError,
-			Body: []byte(err.Error()),
-		})
+		return sendResourceError(sender, http.StatusBadRequest, err.Error())
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	things, err := d.things(ctx, d.apiPath(segments...))
+	spanError(span, err)
 	if err != nil {
-		return sender.Send(&backend.CallResourceResponse{
-			Status: http.StatusInternalServerError,
-			Body: []byte(err.Error()),
-		})
+		d.log(ctx).Warn("Listing things failed", "path", req.Path, "error", err)
+		status, _ := classifyError(err)
+		return sendResourceError(sender, int(status), err.Error())
 	}
-	if resp.StatusCode != 200 {
-		return sender.Send(&backend.CallResourceResponse{
-			Status: resp.StatusCode,
-			Body: []byte(body),
-		})
-	}
-	var things []models.ThingWithLocation
-	err = json.Unmarshal(body, &things)
+	resource, err := d.thingsWithDataStreams(ctx, things)
+	spanError(span, err)
 	if err != nil {
-		return sender.Send(&backend.CallResourceResponse{
-			Status: http.StatusInternalServerError,
-			Body: []byte(err.Error()),
-		})
-	}
-	resource := make([]models.ThingWithDataStreams, 0, len(things))
-	for _, thing := range things {
-		parts := []string{d.Config.BasePath, QUERY_ROOT, thing.Id, QUERY_COLLECTION}
-		url := strings.Join(parts, "/")
-		getReq, err = d.request(url)
-		if err != nil {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusInternalServerError,
-				Body: []byte(err.Error()),
-			})
-		}
-		resp, err = d.Client.Do(getReq)
-		if err != nil {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusInternalServerError,
-				Body: []byte(err.Error()),
-			})
-		}
-		defer resp.Body.Close()
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusInternalServerError,
-				Body: []byte(err.Error()),
-			})
-		}
-		if resp.StatusCode != 200 {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusInternalServerError,
-				Body: []byte(body),
-			})
-		}
-		var dataStreams []models.DataStream
-		err = json.Unmarshal(body, &dataStreams)
-		if err != nil {
-			return sender.Send(&backend.CallResourceResponse{
-				Status: http.StatusInternalServerError,
-				Body: []byte(err.Error()),
-			})
-		}
-		resource = append(resource, models.ThingWithDataStreams{
-			Thing:        thing,
-			DataStreams: dataStreams,
-		})
+		d.log(ctx).Warn("Listing datastreams failed", "path", req.Path, "error", err)
+		status, _ := classifyError(err)
+		return sendResourceError(sender, int(status), err.Error())
 	}
-	
 	result, err := json.Marshal(resource)
 	if err != nil {
-		return sender.Send(&backend.CallResourceResponse{
-			Status: http.StatusInternalServerError,
-			Body: []byte(err.Error()),
-		})
+		return sendResourceError(sender, http.StatusInternalServerError, err.Error())
 	}
 	return sender.Send(&backend.CallResourceResponse{
 		Status: http.StatusOK,
@@ -259,173 +353,500 @@ func (d *Datasource) CallResource(
 	})
 }
 
+// Reply to a resource call with an error status and plain text body.
+func sendResourceError(sender backend.CallResourceResponseSender, status int, message string) error {
+	return sender.Send(&backend.CallResourceResponse{
+		Status: status,
+		Body:   []byte(message),
+	})
+}
+
+// Error explaining which settings must be fixed before the datasource works.
+func (d *Datasource) invalidSettings() error {
+	if d.settingsErr == nil {
+		return nil
+	}
+	return backend.DownstreamErrorf("invalid datasource settings: %w", d.settingsErr)
+}
+
+// Look up the datastreams of each thing with a bounded number of requests
+// in flight. Results keep the order of things, and the first failure or
+// cancellation of the context stops further lookups.
+func (d *Datasource) thingsWithDataStreams(ctx context.Context, things []models.ThingWithLocation) ([]models.ThingWithDataStreams, error) {
+	resource := make([]models.ThingWithDataStreams, len(things))
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(d.resourceConcurrency())
+	for i, thing := range things {
+		group.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			dataStreams, err := d.dataStreams(ctx, thing.Id)
+			if err != nil {
+				return err
+			}
+			resource[i] = models.ThingWithDataStreams{
+				Thing:       thing,
+				DataStreams: dataStreams,
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return resource, nil
+}
+
+// Number of datastream lookups allowed in flight for one resource call.
+func (d *Datasource) resourceConcurrency() int {
+	if d.Config.ResourceConcurrency > 0 {
+		return d.Config.ResourceConcurrency
+	}
+	return RESOURCE_CONCURRENCY
+}
+
 // Selection data from the frontend query editor
 type QueryModel struct {
 	ThingId string `json:"thingId"`
+	// Datastreams picked in the editor, or all of the thing when empty
+	DataStreamIds dataStreamIdList `json:"dataStreamIds"`
+	// Calendar bucket size for aggregate queries
+	Interval string `json:"interval"`
+	// IANA timezone name used to align calendar buckets
+	Timezone string `json:"timezone"`
+	// Percentiles in the range 0-100 to include in aggregate tables
+	Percentiles []float64 `json:"percentiles"`
+	// Restrict analysis to a single datastream, or all when empty
+	DataStreamId string `json:"dataStreamId"`
+	// Value to compare observations against in threshold queries
+	Threshold *float64 `json:"threshold"`
+	// Whether exceedance means above or below the threshold
+	Direction string `json:"direction"`
+	// Options for anomaly detection queries
+	Detector DetectorModel `json:"detector"`
+	// Mapping of event or status values to annotation text
+	Rules []AnnotationRule `json:"rules"`
+	// Collapse repeated matches of the same rule into one annotation
+	ChangesOnly bool `json:"changesOnly"`
+	// Append new observations through the live channel of each datastream
+	Live bool `json:"live"`
+}
+
+// Datastream ids of a query. Older queries saved them as one comma
+// separated string, which is still accepted.
+type dataStreamIdList []string
+
+func (l *dataStreamIdList) UnmarshalJSON(raw []byte) error {
+	var joined string
+	if err := json.Unmarshal(raw, &joined); err != nil {
+		return json.Unmarshal(raw, (*[]string)(l))
+	}
+	*l = nil
+	for _, id := range strings.Split(joined, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			*l = append(*l, id)
+		}
+	}
+	return nil
+}
+
+// Whether a datastream of the thing takes part in the query. The analyzed
+// datastream is always fetched, even when not picked.
+func (qm QueryModel) selects(id string) bool {
+	return len(qm.DataStreamIds) == 0 || slices.Contains(qm.DataStreamIds, id) || qm.DataStreamId == id
 }
 
 // Convenience function to make request with configured secrets and params.
-func (d *Datasource) request(path string) (*http.Request, error) {
-	return signedGetRequest(d.Config.ServerUrl, path, d.Config.Secrets.ClientId, d.Config.Secrets.SecretKey, d.Config.AuthMethod, "\n")
+func (d *Datasource) request(ctx context.Context, path string) (*http.Request, error) {
+	_, span := startSpan(ctx, "sign request", attribute.String(ATTR_ENDPOINT, endpointKind(path)))
+	defer span.End()
+	req, err := signedGetRequest(ctx, d.Config.ServerUrl, path, d.Config.Secrets.ClientId, d.Config.Secrets.SecretKey, d.Config.AuthMethod, "\n")
+	spanError(span, err)
+	return req, err
 }
 
-// Handler for a single frontend query.
-func (d *Datasource) query(_ context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
-	var response backend.DataResponse
-	var qm QueryModel
-	err := json.Unmarshal(query.JSON, &qm)
+// Response from the vendor API with a status other than 200.
+type upstreamError struct {
+	StatusCode int
+	Body       string
+	// Wait asked for by a 429 or 503 response
+	RetryAfter time.Duration
+	throttled  bool
+}
+
+// Signed GET of an API path, returning the body of a successful response.
+// Identical requests already in flight are shared rather than repeated, and
+// each caller stops waiting when its own context is done. The shared request
+// is cancelled once no caller is waiting for it, and its waits are measured
+// against the latest deadline among the callers still waiting.
+func (d *Datasource) get(ctx context.Context, path string) ([]byte, error) {
+	fetched, err := d.inflight.do(ctx, path, func(request *sharedRequest) (fetchResult, error) {
+		return d.fetch(request.ctx, path, func() (time.Time, bool) {
+			return d.inflight.deadline(request)
+		})
+	})
+	if ctx.Err() != nil {
+		return nil, backend.DownstreamError(ctx.Err())
+	}
+	countUpstream(ctx, fetched.attempts, len(fetched.body))
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("json unmarshal: %v", err.Error()))
+		return nil, err
+	}
+	return fetched.body, nil
+}
+
+// Body of a response, and the attempts it took.
+type fetchResult struct {
+	body     []byte
+	attempts int
+}
+
+// Signed GET of an API path within the rate limit. Transient failures are
+// retried with backoff, and when the server asks the client to slow down,
+// the request is repeated after the wait it gives. Waits that would outlast
+// the context deadline, or the deadline of the callers, are not started.
+// Each attempt is signed afresh, since the signature covers the time of the
+// request. The whole exchange is bounded by the overall request timeout.
+func (d *Datasource) fetch(parent context.Context, path string, callers func() (time.Time, bool)) (fetchResult, error) {
+	ctx, cancel := context.WithTimeout(parent, d.requestTimeout())
+	defer cancel()
+	result, err := d.fetchWithin(ctx, path, callers)
+	if err != nil && ctx.Err() != nil && parent.Err() == nil {
+		return result, backend.DownstreamErrorf("%w after %s", errRequestTimeout, d.requestTimeout())
+	}
+	return result, err
+}
+
+// Attempts of a signed GET until success, a permanent failure, or the
+// context is done.
+func (d *Datasource) fetchWithin(ctx context.Context, path string, callers func() (time.Time, bool)) (fetchResult, error) {
+	throttled := 0
+	for attempt := 1; ; attempt++ {
+		err := d.limiter.wait(ctx)
+		if err != nil {
+			return fetchResult{attempts: attempt - 1}, backend.DownstreamError(err)
+		}
+		body, err := d.fetchOnce(ctx, path, attempt)
+		if err == nil {
+			return fetchResult{body: body, attempts: attempt}, nil
+		}
+		var delay time.Duration
+		var upstream *upstreamError
+		deadline, hasDeadline := ctx.Deadline()
+		if latest, ok := callers(); ok && (!hasDeadline || latest.Before(deadline)) {
+			deadline, hasDeadline = latest, true
+		}
+		switch {
+		case errors.As(err, &upstream) && upstream.throttled:
+			throttled++
+			delay = upstream.RetryAfter
+			d.limiter.block(time.Now().Add(delay))
+			if throttled > RATE_LIMIT_RETRIES || hasDeadline && time.Now().Add(delay).After(deadline) {
+				rateLimited.Inc()
+				d.log(ctx).Warn("Giving up on rate limited upstream request", "path", path, "attempt", attempt, "retryAfter", delay)
+				return fetchResult{attempts: attempt}, backend.DownstreamError(&rateLimitError{Wait: delay})
+			}
+			d.log(ctx).Info("Retrying rate limited upstream request", "path", path, "attempt", attempt, "retryAfter", delay)
+			upstreamRetries.WithLabelValues(endpointKind(path), "throttled").Inc()
+			rateLimitWaits.Observe(delay.Seconds())
+		case retryable(err) && attempt < d.retryAttempts():
+			delay = d.backoff(attempt)
+			if hasDeadline && time.Now().Add(delay).After(deadline) {
+				d.log(ctx).Warn("Not retrying upstream request past the deadline", "path", path, "attempt", attempt, "error", err)
+				return fetchResult{attempts: attempt}, err
+			}
+			d.log(ctx).Info("Retrying upstream request", "path", path, "attempt", attempt, "backoff", delay, "error", err)
+			upstreamRetries.WithLabelValues(endpointKind(path), "transient").Inc()
+		default:
+			return fetchResult{attempts: attempt}, err
+		}
+		err = sleep(ctx, delay)
+		if err != nil {
+			return fetchResult{attempts: attempt}, backend.DownstreamError(err)
+		}
 	}
-	parts := []string{d.Config.BasePath, QUERY_ROOT, qm.ThingId, QUERY_COLLECTION}
-	url := strings.Join(parts, "/")
-	req, err := d.request(url)
+}
+
+// Perform a single signed GET of an API path, passing on the trace context.
+// Failures talking to the server are marked as downstream errors.
+func (d *Datasource) fetchOnce(ctx context.Context, path string, attempt int) (body []byte, err error) {
+	ctx, span := startSpan(ctx, "upstream request",
+		attribute.String(ATTR_ENDPOINT, endpointKind(path)),
+		attribute.Int(ATTR_ATTEMPT, attempt),
+	)
+	defer func() {
+		spanError(span, err)
+		span.End()
+	}()
+	req, err := d.request(ctx, path)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("request: %v", err.Error()))
+		signingFailures.Inc()
+		d.log(ctx).Error("Signing upstream request failed", "path", path, "error", err)
+		return nil, backend.PluginErrorf("signed request: %w", err)
 	}
+	start := time.Now()
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 	resp, err := d.Client.Do(req)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("request: %v", err.Error()))
+		observeUpstream(path, 0, time.Since(start))
+		d.log(ctx).Warn("Upstream request failed", "path", path, "attempt", attempt, "duration", time.Since(start), "error", err)
+		return nil, backend.DownstreamErrorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	body, err = io.ReadAll(resp.Body)
+	observeUpstream(path, resp.StatusCode, time.Since(start))
+	d.log(ctx).Debug("Upstream request", "path", path, "status", resp.StatusCode, "attempt", attempt, "duration", time.Since(start), "bytes", len(body))
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("body: %v", err.Error()))
+		return nil, backend.DownstreamErrorf("reading body: %w", err)
 	}
 	if resp.StatusCode != 200 {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("request: %v", string(body)))
-	}
-	var dataStreams []models.DataStream
-	err = json.Unmarshal(body, &dataStreams)
-	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("unmarshal: %v", err.Error()))
-	}
-	var tags []string
-	var lookup = make(map[string]string)
-	for _, ds := range dataStreams {
-		tags = append(tags, ds.Id)
-		lookup[ds.Id] = ds.Name
+		wait, throttled := retryAfter(resp, time.Now())
+		return nil, backend.DownstreamError(&upstreamError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+			RetryAfter: wait,
+			throttled:  throttled,
+		})
 	}
-	from := query.TimeRange.From.Format(ISO_COMPATIBILITY)
-	until := query.TimeRange.To.Format(ISO_COMPATIBILITY)
-	path := d.Config.BasePath + QUERY_PATH + 
-		"?" + QUERY_START + "=" + from + 
-		"&" + QUERY_END + "=" + until + 
-		"&" + QUERY_TAGS + "=" + strings.Join(tags, ",")
+	return body, nil
+}
 
-	getReq, err := d.request(path)
+// Things listed at an API path, from the metadata cache when possible.
+func (d *Datasource) things(ctx context.Context, path string) ([]models.ThingWithLocation, error) {
+	var cache *ttlCache[[]models.ThingWithLocation]
+	if d.metadata != nil {
+		cache = d.metadata.things
+	}
+	return cache.get(ctx, path, func(ctx context.Context) ([]models.ThingWithLocation, error) {
+		body, err := d.get(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		_, span := startSpan(ctx, "decode things")
+		defer span.End()
+		var things []models.ThingWithLocation
+		err = json.Unmarshal(body, &things)
+		if err != nil {
+			d.log(ctx).Error("Decoding things failed", "path", path, "error", err)
+			return nil, tracing.Error(span, backend.PluginErrorf("unmarshal: %w", err))
+		}
+		span.SetAttributes(attribute.Int("hmac.thing_count", len(things)))
+		if err := d.diskStore.putMetadata(BUCKET_THINGS, path, things, time.Now()); err != nil {
+			d.log(ctx).Warn("Persisting things failed", "path", path, "error", err)
+		}
+		return things, nil
+	})
+}
+
+// Datastreams belonging to a thing, from the metadata cache when possible.
+func (d *Datasource) dataStreams(ctx context.Context, thingId string) ([]models.DataStream, error) {
+	var cache *ttlCache[[]models.DataStream]
+	if d.metadata != nil {
+		cache = d.metadata.dataStreams
+	}
+	return cache.get(ctx, thingId, func(ctx context.Context) ([]models.DataStream, error) {
+		dataStreams, err := d.fetchDataStreams(ctx, thingId)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.diskStore.putMetadata(BUCKET_DATASTREAMS, thingId, dataStreams, time.Now()); err != nil {
+			d.log(ctx).Warn("Persisting datastreams failed", "thingId", thingId, "error", err)
+		}
+		return dataStreams, nil
+	})
+}
+
+// Fetch the datastreams belonging to a thing.
+func (d *Datasource) fetchDataStreams(ctx context.Context, thingId string) ([]models.DataStream, error) {
+	body, err := d.get(ctx, d.apiPath(QUERY_ROOT, thingId, QUERY_COLLECTION))
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("signed request: %v", err.Error()))
+		return nil, err
 	}
-	resp, err = d.Client.Do(getReq)
+	_, span := startSpan(ctx, "decode datastreams", attribute.String(ATTR_THING_ID, thingId))
+	defer span.End()
+	var dataStreams []models.DataStream
+	err = json.Unmarshal(body, &dataStreams)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("request failed: %v", err.Error()))
+		d.log(ctx).Error("Decoding datastreams failed", "thingId", thingId, "error", err)
+		return nil, tracing.Error(span, backend.PluginErrorf("unmarshal: %w", err))
 	}
-	defer resp.Body.Close()
-	body, err = io.ReadAll(resp.Body)
+	span.SetAttributes(attribute.Int(ATTR_DATASTREAMS, len(dataStreams)))
+	return dataStreams, nil
+}
+
+// Fetch observations of the datastreams between two times, decoded
+// by datastream id.
+func (d *Datasource) fetchObservations(ctx context.Context, ids []string, from time.Time, until time.Time) (map[string][]models.Observation, map[string]error, error) {
+	path := d.observationsPath(ids, from, until)
+	body, err := d.get(ctx, path)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("reading body: %v", err.Error()))
-	}
-	if resp.StatusCode != 200 {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("request failed: %v", string(body)))
+		return nil, nil, err
 	}
+	_, span := startSpan(ctx, "decode observations", attribute.Int(ATTR_DATASTREAMS, len(ids)))
+	defer span.End()
 	var partial map[string]json.RawMessage
 	err = json.Unmarshal(body, &partial)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("partial unmarshaling failed: %v", err.Error()))
+		d.log(ctx).Error("Decoding observations failed", "datastreams", len(ids), "error", err)
+		return nil, nil, tracing.Error(span, backend.PluginErrorf("partial unmarshaling failed: %w", err))
 	}
+	series := make(map[string][]models.Observation, len(partial))
+	failed := make(map[string]error)
+	points := 0
 	for k, v := range partial {
 		var obs []models.Observation
 		err = json.Unmarshal(v, &obs)
 		if err != nil {
+			d.log(ctx).Warn("Skipping datastream with undecodable observations", "datastream", k, "error", err)
+			failed[k] = backend.PluginErrorf("decoding observations: %w", err)
 			continue
 		}
-		t := make([]time.Time, len(obs))
-		value := make([]float64, len(obs))
-		count := 0
-		for i, observation := range obs {
-			if math.IsNaN(observation.Value) {
-				continue
-			}
-			t[i] = time.Unix(0, observation.PhenomenonTime*int64(time.Millisecond))
-			value[i] = observation.Value
-			count += 1
-		}
-		if count == 0 {
-			continue
-		}
-		name := lookup[k]
-		frame := data.NewFrame(name)
-		frame.Fields = append(frame.Fields,
-			data.NewField("phenomenonTime", nil, t),
-			data.NewField("value", nil, value),
-		)
-		response.Frames = append(response.Frames, frame)
+		series[k] = obs
+		points += len(obs)
 	}
-	return response
+	span.SetAttributes(attribute.Int(ATTR_POINTS, points))
+	return series, failed, nil
 }
 
-// CheckHealth handles health checks sent from Grafana to the plugin.
-// The main use case for these health checks is the test button on the
-// datasource configuration page which allows users to verify that
-// a datasource is working as expected.
-func (d *Datasource) CheckHealth(_ context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	res := &backend.CheckHealthResult{
-		Status: backend.HealthStatusError,
-	}
-	if d.Config.Secrets.SecretKey == "" {
-		res.Message = "HMAC signing key is missing"
-		return res, nil
-	}
-	if d.Config.Secrets.ClientId == "" {
-		res.Message = "Client ID is missing"
-		return res, nil
-	}
-	if d.Config.ServerUrl == "" {
-		res.Message = "Server URL is missing"
-		return res, nil
-	}
-	if d.Config.BasePath == "" {
-		res.Message = "BasePath is missing"
-		return res, nil
-	}
-	if d.Config.AuthMethod == "" {
-		res.Message = "AuthMethod is missing"
-		return res, nil
+// Handler for a single frontend query.
+func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, lookups *dataStreamLookups) backend.DataResponse {
+	ctx, span := startSpan(ctx, "query",
+		attribute.String("hmac.ref_id", query.RefID),
+		attribute.String("hmac.query_type", query.QueryType),
+	)
+	defer span.End()
+	response := d.runQuery(ctx, pCtx, query, lookups)
+	spanError(span, response.Error)
+	if response.Error != nil {
+		d.log(ctx).Warn("Query failed", "refId", query.RefID, "queryType", query.QueryType, "status", response.Status, "error", response.Error)
 	}
-	path := strings.Join([]string{d.Config.BasePath, INDEX_NAME}, "/")
-	getReq, err := d.request(path)
+	return response
+}
+
+// Validate a query, fetch its observations and build frames of its type.
+func (d *Datasource) runQuery(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery, lookups *dataStreamLookups) backend.DataResponse {
+	var qm QueryModel
+	err := json.Unmarshal(query.JSON, &qm)
 	if err != nil {
-		res.Message = "Request failed:" + err.Error()
-		return res, nil
+		return backend.ErrDataResponseWithSource(backend.StatusBadRequest, backend.ErrorSourceDownstream, fmt.Sprintf("json unmarshal: %v", err.Error()))
 	}
-	resp, err := d.Client.Do(getReq)
+	if qm.ThingId == "" {
+		return backend.ErrDataResponseWithSource(backend.StatusBadRequest, backend.ErrorSourceDownstream, "thingId is required")
+	}
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String(ATTR_THING_ID, qm.ThingId))
+	ctx, stats := withUpstreamStats(ctx)
+	lookup, series, failed, err := d.observations(ctx, qm, query.TimeRange, lookups)
 	if err != nil {
-		res.Message = "Request failed:" + err.Error()
-		return res, nil
+		status, source := classifyError(err)
+		return backend.ErrDataResponseWithSource(status, source, err.Error())
+	}
+	points := 0
+	for _, obs := range series {
+		points += len(obs)
+	}
+	span.SetAttributes(
+		attribute.Int(ATTR_DATASTREAMS, len(lookup)),
+		attribute.Int(ATTR_POINTS, points),
+	)
+	_, build := startSpan(ctx, "build frames", attribute.Int(ATTR_POINTS, points))
+	var response backend.DataResponse
+	switch query.QueryType {
+	case QUERY_TYPE_CALENDAR:
+		response = calendarResponse(qm, lookup, series)
+	case QUERY_TYPE_THRESHOLD:
+		response = thresholdResponse(qm, lookup, series)
+	case QUERY_TYPE_ANOMALY:
+		response = anomalyResponse(qm, lookup, series)
+	case QUERY_TYPE_ANNOTATIONS:
+		response = annotationResponse(qm, lookup, series)
+	default:
+		response = timeSeriesResponse(qm.ThingId, lookup, series)
+		if qm.Live {
+			setLiveChannels(&response, pCtx, qm.ThingId, query.TimeRange.To)
+		}
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	attachNotices(&response, qm.ThingId, dataStreamNotices(qm, lookup, series, failed))
+	build.SetAttributes(attribute.Int("hmac.frame_count", len(response.Frames)))
+	spanError(build, response.Error)
+	build.End()
+	queryPoints.Observe(float64(points))
+	queryBytes.Observe(float64(stats.bytes.Load()))
+	recordAttempts(&response, stats.attempts.Load())
+	return response
+}
+
+// Fetch the datastreams of the selected thing, and the observations of
+// those the query selects within the time range. Returns the id to name lookup, the decoded
+// observations by datastream id, and why any datastreams failed.
+func (d *Datasource) observations(ctx context.Context, qm QueryModel, timeRange backend.TimeRange, lookups *dataStreamLookups) (map[string]string, map[string][]models.Observation, map[string]error, error) {
+	dataStreams, err := lookups.get(qm.ThingId, func(thingId string) ([]models.DataStream, error) {
+		return d.dataStreams(ctx, thingId)
+	})
 	if err != nil {
-		res.Message = "Error reading body:" + err.Error()
-		return res, nil
+		return nil, nil, nil, err
 	}
-	if resp.StatusCode != 200 {
-		res.Message = "Request failed:" + string(body)
-		return res, nil
+	var tags []string
+	var lookup = make(map[string]string)
+	for _, ds := range dataStreams {
+		if !qm.selects(ds.Id) {
+			continue
+		}
+		tags = append(tags, ds.Id)
+		lookup[ds.Id] = ds.Name
 	}
-	var things []models.ThingWithLocation
-	err = json.Unmarshal(body, &things)
+	series, failed, err := d.cachedObservations(ctx, tags, timeRange.From, timeRange.To)
 	if err != nil {
-		res.Message = "Unmarshaling failed:" + err.Error()
-		return res, nil
+		return nil, nil, nil, err
 	}
-	if len(things) == 0 {
-		res.Message = "No root nodes found"
-		return res, nil
+	return lookup, series, failed, nil
+}
+
+// Convert observations to one time series frame per datastream. Frames are
+// ordered by datastream id and points by time, so that alert rules see the
+// same series on every evaluation.
+func timeSeriesResponse(thingId string, lookup map[string]string, series map[string][]models.Observation) backend.DataResponse {
+	var response backend.DataResponse
+	ids := make([]string, 0, len(series))
+	for k := range series {
+		ids = append(ids, k)
+	}
+	sort.Strings(ids)
+	for _, k := range ids {
+		obs := sortedObservations(series[k])
+		if len(obs) == 0 {
+			continue
+		}
+		response.Frames = append(response.Frames, observationFrame(thingId, k, lookup, obs))
 	}
-	return &backend.CheckHealthResult{
-		Status:  backend.HealthStatusOk,
-		Message: "Data source is working",
-	}, nil
+	return response
+}
+
+// Time series frame of the sorted observations of one datastream, named
+// after the datastream when its name is known.
+func observationFrame(thingId string, k string, lookup map[string]string, obs []models.Observation) *data.Frame {
+	t := make([]time.Time, len(obs))
+	value := make([]float64, len(obs))
+	for i, observation := range obs {
+		t[i] = time.Unix(0, observation.PhenomenonTime*int64(time.Millisecond))
+		value[i] = observation.Value
+	}
+	name, ok := lookup[k]
+	if !ok || name == "" {
+		name = k
+	}
+	labels := data.Labels{"thing": thingId, "datastream": k}
+	frame := data.NewFrame(name,
+		data.NewField("phenomenonTime", nil, t),
+		data.NewField("value", labels, value).SetConfig(&data.FieldConfig{
+			DisplayNameFromDS: name,
+		}),
+	)
+	frame.SetMeta(&data.FrameMeta{
+		Type:        data.FrameTypeTimeSeriesMulti,
+		TypeVersion: data.FrameTypeVersion{0, 1},
+	})
+	return frame
 }
@@ -3,10 +3,13 @@ package plugin
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 	"unicode/utf8"
@@ -72,7 +75,7 @@ func TestQueryThings(t *testing.T) {
 	client := http.Client{}
 	clientId := os.Getenv("CLIENT_ID")
 	secretKey := os.Getenv("SECRET_KEY")
-	req, err := signedGetRequest(SERVER_URL, REFERENCE_ENDPOINT, clientId, secretKey, AUTH_METHOD, DELIMITER)
+	req, err := signedGetRequest(context.Background(), SERVER_URL, REFERENCE_ENDPOINT, clientId, secretKey, AUTH_METHOD, DELIMITER)
 	if err != nil {
 		t.Fatal("Request failed with: ", err)
 	}
@@ -103,7 +106,7 @@ func TestQueryDataStreams(t *testing.T) {
 	clientId := os.Getenv("CLIENT_ID")
 	secretKey := os.Getenv("SECRET_KEY")
 	datastreamsUrl := "/xcloud/data-export/site/6809170ead845d428de9a636/datastreams"
-	req, err := signedGetRequest(SERVER_URL, datastreamsUrl, clientId, secretKey, AUTH_METHOD, DELIMITER)
+	req, err := signedGetRequest(context.Background(), SERVER_URL, datastreamsUrl, clientId, secretKey, AUTH_METHOD, DELIMITER)
 	if err != nil {
 		t.Fatal("Request failed with: ", err)
 	}
@@ -134,7 +137,7 @@ func TestQueryObservations(t *testing.T) {
 	clientId := os.Getenv("CLIENT_ID")
 	secretKey := os.Getenv("SECRET_KEY")
 	url := "/xcloud/data-export/observations?datastreamIds=2015785,2015786&from=2025-05-20T00:00:00.000Z&until=2025-05-25T00:00:00.000Z"
-	req, err := signedGetRequest(SERVER_URL, url, clientId, secretKey, AUTH_METHOD, DELIMITER)
+	req, err := signedGetRequest(context.Background(), SERVER_URL, url, clientId, secretKey, AUTH_METHOD, DELIMITER)
 	if err != nil {
 		t.Fatal("Request failed with:", err)
 	}
@@ -188,3 +191,238 @@ func TestQueryData(t *testing.T) {
 		t.Fatal("QueryData must return a response")
 	}
 }
+
+// Frames must be ordered the same way on every evaluation for alerting
+func TestTimeSeriesResponseDeterministic(t *testing.T) {
+	series := map[string][]models.Observation{
+		"b": {{Value: 2, PhenomenonTime: 2000}, {Value: 1, PhenomenonTime: 1000}},
+		"a": {{Value: 3, PhenomenonTime: 1000}},
+		"c": {},
+	}
+	lookup := map[string]string{"a": "Salinity", "b": "Temperature"}
+	resp := timeSeriesResponse("site", lookup, series)
+	if len(resp.Frames) != 2 {
+		t.Fatal("frame count =", len(resp.Frames))
+	}
+	if resp.Frames[0].Name != "Salinity" || resp.Frames[1].Name != "Temperature" {
+		t.Fatal("frame order =", resp.Frames[0].Name, resp.Frames[1].Name)
+	}
+	value := resp.Frames[1].Fields[1]
+	if value.Labels["datastream"] != "b" || value.Labels["thing"] != "site" {
+		t.Fatal("labels =", value.Labels)
+	}
+	if first := value.At(0).(float64); first != 1 {
+		t.Fatal("points not sorted by time, first =", first)
+	}
+}
+
+// Datasource configured against a local stand-in for the vendor API.
+func newTestDatasource(t *testing.T, handler http.Handler) *Datasource {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &Datasource{
+		Config: &models.PluginSettings{
+			ServerUrl:  server.URL,
+			BasePath:   "/api",
+			AuthMethod: AUTH_METHOD,
+			Secrets: &models.SecretPluginSettings{
+				SecretKey: "c2VjcmV0",
+				ClientId:  "client",
+			},
+		},
+		Client: server.Client(),
+	}
+}
+
+// Records the response of a resource call.
+type resourceRecorder struct {
+	response *backend.CallResourceResponse
+}
+
+func (r *resourceRecorder) Send(response *backend.CallResourceResponse) error {
+	r.response = response
+	return nil
+}
+
+func TestCallResourceKeepsThingOrder(t *testing.T) {
+	var inFlight, peak int32
+	var mu sync.Mutex
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/sites" {
+			things := make([]models.ThingWithLocation, 20)
+			for i := range things {
+				things[i].Id = fmt.Sprint(i)
+			}
+			json.NewEncoder(w).Encode(things)
+			return
+		}
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		id := strings.Split(r.URL.Path, "/")[3]
+		json.NewEncoder(w).Encode([]models.DataStream{{Id: "ds-" + id}})
+	}))
+	ds.Config.ResourceConcurrency = 4
+	recorder := &resourceRecorder{}
+	err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "sites"}, recorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder.response.Status != http.StatusOK {
+		t.Fatal("status =", recorder.response.Status, string(recorder.response.Body))
+	}
+	var resource []models.ThingWithDataStreams
+	if err := json.Unmarshal(recorder.response.Body, &resource); err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range resource {
+		if item.Thing.Id != fmt.Sprint(i) || item.DataStreams[0].Id != "ds-"+fmt.Sprint(i) {
+			t.Fatal("out of order at", i, item)
+		}
+	}
+	if peak > 4 {
+		t.Fatal("lookups in flight =", peak)
+	}
+}
+
+func TestQueryDataSharesDataStreamLookups(t *testing.T) {
+	var mu sync.Mutex
+	lookups := 0
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/datastreams") {
+			mu.Lock()
+			lookups++
+			mu.Unlock()
+			json.NewEncoder(w).Encode([]models.DataStream{{Id: "1", Name: "Temperature"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]models.Observation{"1": {{Value: 1, PhenomenonTime: 1000}}})
+	}))
+	queries := make([]backend.DataQuery, 5)
+	for i := range queries {
+		queries[i] = backend.DataQuery{RefID: fmt.Sprint(i), JSON: []byte(`{"thingId":"site"}`)}
+	}
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queries {
+		res := resp.Responses[q.RefID]
+		if res.Error != nil || len(res.Frames) != 1 {
+			t.Fatal("response", q.RefID, "=", res.Error, len(res.Frames))
+		}
+	}
+	if lookups != 1 {
+		t.Fatal("datastream lookups =", lookups)
+	}
+}
+
+func TestQueryDataHonorsSelectedDataStreams(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/datastreams") {
+			json.NewEncoder(w).Encode([]models.DataStream{{Id: "1"}, {Id: "2"}, {Id: "3"}})
+			return
+		}
+		tags := r.URL.Query().Get(QUERY_TAGS)
+		mu.Lock()
+		requested = append(requested, tags)
+		mu.Unlock()
+		series := make(map[string][]models.Observation)
+		for _, id := range strings.Split(tags, ",") {
+			series[id] = []models.Observation{{Value: 1, PhenomenonTime: 1000}}
+		}
+		json.NewEncoder(w).Encode(series)
+	}))
+	timeRange := backend.TimeRange{From: time.UnixMilli(0), To: time.UnixMilli(2000)}
+	for _, selection := range []string{`["1","3"]`, `"1,3"`} {
+		requested = nil
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID:     "A",
+				JSON:      []byte(`{"thingId": "site", "dataStreamIds": ` + selection + `}`),
+				TimeRange: timeRange,
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := resp.Responses["A"]
+		if res.Error != nil || len(res.Frames) != 2 {
+			t.Fatal(selection, "response =", res.Error, len(res.Frames))
+		}
+		for i, id := range []string{"1", "3"} {
+			if label := res.Frames[i].Fields[1].Labels["datastream"]; label != id {
+				t.Fatal(selection, "frame", i, "datastream =", label)
+			}
+		}
+		if len(requested) != 1 || requested[0] != "1,3" {
+			t.Fatal(selection, "observations requested for", requested)
+		}
+	}
+}
+
+func TestGetCoalescesConcurrentRequests(t *testing.T) {
+	var calls sync.WaitGroup
+	calls.Add(1)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	requests := 0
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		if requests == 1 {
+			calls.Done()
+		}
+		mu.Unlock()
+		<-release
+		w.Write([]byte(`[]`))
+	}))
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ds.get(context.Background(), "/api/things"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	calls.Wait()
+	// Let the remaining callers join the request in flight
+	time.Sleep(50 * time.Millisecond)
+	// A waiter whose context ends stops waiting without cancelling the others
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ds.get(ctx, "/api/things"); err == nil {
+		t.Fatal("cancelled caller should not wait for the shared request")
+	}
+	close(release)
+	wg.Wait()
+	if requests != 1 {
+		t.Fatal("identical concurrent requests should reach the server once, got", requests)
+	}
+}
+
+func TestSharedRequestOutlivesFirstCaller(t *testing.T) {
+	started := make(chan struct{})
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`[]`))
+	}))
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go ds.get(short, "/api/things")
+	<-started
+	// Joins the request started by the caller with the shorter deadline
+	if _, err := ds.get(context.Background(), "/api/things"); err != nil {
+		t.Fatal("shared request failed with the first caller's deadline:", err)
+	}
+}
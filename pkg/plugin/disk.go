@@ -0,0 +1,504 @@
+package plugin
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Environment variable holding the Grafana data directory.
+const DATA_PATH_ENV = "GF_PATHS_DATA"
+// Directory under the Grafana data directory holding this plugin's files.
+const DISK_CACHE_NAME = "hurricaneisland-hmac-datasource"
+// Size of the cache file before least recently used series are dropped.
+const DISK_CACHE_MAX_MB = 512
+// Observations older than this are treated as immutable and persisted.
+const DISK_CACHE_AGE = 24 * time.Hour
+// Fraction of the size cap kept after eviction, so compaction is not
+// repeated on every write.
+const DISK_CACHE_LOW_WATER = 0.8
+// Longest time access times of read series are held before being written.
+const DISK_CACHE_TOUCH_INTERVAL = time.Minute
+
+// Bucket names in the cache file.
+var (
+	BUCKET_COVERAGE    = []byte("coverage")
+	BUCKET_POINTS      = []byte("points")
+	BUCKET_USED        = []byte("used")
+	BUCKET_THINGS      = []byte("things")
+	BUCKET_DATASTREAMS = []byte("datastreams")
+)
+
+// Metadata value with the time it was fetched, so that time to live
+// carries across restarts.
+type diskMetadata struct {
+	Fetched time.Time       `json:"fetched"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// Persistent store of settled historical observations and metadata, kept
+// in an embedded key value file. One store is shared by all datasource
+// instances using the same file, because instances are replaced before
+// the old one is disposed.
+type diskStore struct {
+	// Held for writing only while compaction swaps the file
+	mu       sync.RWMutex
+	db       *bolt.DB
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+	now      func() time.Time
+	// Datasource instances using the store
+	refs int
+	// Access times of series read since they were last written, so that
+	// reads do not each need a write transaction
+	usedMu    sync.Mutex
+	used      map[string]int64
+	usedSaved time.Time
+}
+
+// Open stores by file path.
+var diskStores = struct {
+	sync.Mutex
+	open map[string]*diskStore
+}{open: make(map[string]*diskStore)}
+
+// Directory holding cache files, under the Grafana data directory. The
+// location is never taken from datasource settings, which editors can change.
+func diskCacheDir() (string, error) {
+	dataPath := os.Getenv(DATA_PATH_ENV)
+	if dataPath == "" {
+		return "", fmt.Errorf("disk cache needs %s to be set", DATA_PATH_ENV)
+	}
+	return filepath.Join(dataPath, DISK_CACHE_NAME), nil
+}
+
+// Open or share the cache file for a datasource.
+func acquireDiskStore(config *models.PluginSettings, uid string) (*diskStore, error) {
+	maxBytes := int64(config.DiskCacheMaxMb) << 20
+	if maxBytes <= 0 {
+		maxBytes = DISK_CACHE_MAX_MB << 20
+	}
+	maxAge := time.Duration(config.DiskCacheAgeHours) * time.Hour
+	if maxAge <= 0 {
+		maxAge = DISK_CACHE_AGE
+	}
+	if uid == "" || filepath.Base(uid) != uid {
+		return nil, fmt.Errorf("disk cache: invalid datasource uid %q", uid)
+	}
+	dir, err := diskCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, uid+".db")
+	diskStores.Lock()
+	defer diskStores.Unlock()
+	if store, ok := diskStores.open[path]; ok {
+		store.refs++
+		store.mu.Lock()
+		store.maxBytes = maxBytes
+		store.maxAge = maxAge
+		store.mu.Unlock()
+		return store, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	store := &diskStore{path: path, maxBytes: maxBytes, maxAge: maxAge, now: time.Now, refs: 1, used: make(map[string]int64)}
+	if err := store.open(); err != nil {
+		return nil, err
+	}
+	if err := store.enforceCap(); err != nil {
+		store.db.Close()
+		return nil, err
+	}
+	diskStores.open[path] = store
+	return store, nil
+}
+
+// Stop using the store, closing the file when no instance uses it.
+func (s *diskStore) release() {
+	if s == nil {
+		return
+	}
+	diskStores.Lock()
+	defer diskStores.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+	delete(diskStores.open, s.path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db.Update(s.saveUsed)
+	s.db.Close()
+}
+
+// Open the file and create the buckets.
+func (s *diskStore) open() error {
+	db, err := bolt.Open(s.path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("disk cache %s: %w", s.path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{BUCKET_COVERAGE, BUCKET_POINTS, BUCKET_USED, BUCKET_THINGS, BUCKET_DATASTREAMS} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+// Key ordering observations by time.
+func pointKey(t int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t))
+	return key
+}
+
+// Coverage of a datastream recorded in the file.
+func readCoverage(tx *bolt.Tx, id string) []timeInterval {
+	var intervals []timeInterval
+	if raw := tx.Bucket(BUCKET_COVERAGE).Get([]byte(id)); raw != nil {
+		json.Unmarshal(raw, &intervals)
+	}
+	return intervals
+}
+
+// Mark a datastream as used now, for eviction. The time is written with
+// the next write transaction.
+func (s *diskStore) touch(id string) {
+	s.usedMu.Lock()
+	defer s.usedMu.Unlock()
+	s.used[id] = s.now().UnixNano()
+}
+
+// Write the access times held since the last write.
+func (s *diskStore) saveUsed(tx *bolt.Tx) error {
+	s.usedMu.Lock()
+	defer s.usedMu.Unlock()
+	for id, at := range s.used {
+		if err := tx.Bucket(BUCKET_USED).Put([]byte(id), pointKey(at)); err != nil {
+			return err
+		}
+	}
+	clear(s.used)
+	s.usedSaved = s.now()
+	return nil
+}
+
+// Whether held access times are due to be written.
+func (s *diskStore) usedDue() bool {
+	s.usedMu.Lock()
+	defer s.usedMu.Unlock()
+	return len(s.used) > 0 && s.now().Sub(s.usedSaved) >= DISK_CACHE_TOUCH_INTERVAL
+}
+
+// Persisted intervals overlapping the range, clipped to it, and the
+// observations within them.
+func (s *diskStore) load(id string, want timeInterval) ([]timeInterval, []models.Observation, error) {
+	if s == nil {
+		return nil, nil, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var covered []timeInterval
+	var points []models.Observation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, c := range readCoverage(tx, id) {
+			if c.Until < want.From || c.From > want.Until {
+				continue
+			}
+			covered = append(covered, timeInterval{From: max(c.From, want.From), Until: min(c.Until, want.Until)})
+		}
+		if len(covered) == 0 {
+			return nil
+		}
+		bucket := tx.Bucket(BUCKET_POINTS).Bucket([]byte(id))
+		if bucket != nil {
+			cursor := bucket.Cursor()
+			for k, v := cursor.Seek(pointKey(want.From)); k != nil; k, v = cursor.Next() {
+				t := int64(binary.BigEndian.Uint64(k))
+				if t > want.Until {
+					break
+				}
+				value := math.Float64frombits(binary.BigEndian.Uint64(v))
+				points = append(points, models.Observation{Value: value, PhenomenonTime: t})
+			}
+		}
+		return nil
+	})
+	if err != nil || len(covered) == 0 {
+		return covered, points, err
+	}
+	s.touch(id)
+	if s.usedDue() {
+		// Concurrent reads share one transaction
+		err = s.db.Batch(s.saveUsed)
+	}
+	return covered, points, err
+}
+
+// Persist the part of a fetched range old enough to be immutable.
+func (s *diskStore) store(id string, fetched timeInterval, obs []models.Observation) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	fetched.Until = min(fetched.Until, s.now().Add(-s.maxAge).UnixMilli())
+	if fetched.Until < fetched.From {
+		s.mu.RUnlock()
+		return nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(BUCKET_POINTS).CreateBucketIfNotExists([]byte(id))
+		if err != nil {
+			return err
+		}
+		for _, o := range obs {
+			if o.PhenomenonTime < fetched.From || o.PhenomenonTime > fetched.Until || math.IsNaN(o.Value) {
+				continue
+			}
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, math.Float64bits(o.Value))
+			if err := bucket.Put(pointKey(o.PhenomenonTime), value); err != nil {
+				return err
+			}
+		}
+		coverage, err := json.Marshal(addInterval(readCoverage(tx, id), fetched))
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(BUCKET_COVERAGE).Put([]byte(id), coverage); err != nil {
+			return err
+		}
+		s.touch(id)
+		return s.saveUsed(tx)
+	})
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return s.enforceCap()
+}
+
+// Remember a metadata response, with the time it was fetched.
+func (s *diskStore) putMetadata(bucket []byte, key string, value any, fetched time.Time) error {
+	if s == nil {
+		return nil
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(diskMetadata{Fetched: fetched, Value: raw})
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), entry)
+	})
+}
+
+// All persisted metadata in a bucket.
+func (s *diskStore) metadata(bucket []byte) (map[string]diskMetadata, error) {
+	result := make(map[string]diskMetadata)
+	if s == nil {
+		return result, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			var entry diskMetadata
+			if err := json.Unmarshal(v, &entry); err == nil {
+				result[string(k)] = entry
+			}
+			return nil
+		})
+	})
+	return result, err
+}
+
+// Size of the cache file in bytes.
+func (s *diskStore) size() int64 {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// When the file exceeds the size cap, drop least recently used series until
+// the live data fits under the low water mark, then compact the file to
+// return the freed pages to the file system.
+func (s *diskStore) enforceCap() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fileSize := s.size()
+	if fileSize <= s.maxBytes {
+		return nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := s.saveUsed(tx); err != nil {
+			return err
+		}
+		type usage struct {
+			id    string
+			used  uint64
+			bytes int
+		}
+		var series []usage
+		live := 0
+		points := tx.Bucket(BUCKET_POINTS)
+		used := tx.Bucket(BUCKET_USED)
+		err := points.ForEachBucket(func(k []byte) error {
+			stats := points.Bucket(k).Stats()
+			bytes := stats.BranchAlloc + stats.LeafAlloc
+			var at uint64
+			if v := used.Get(k); v != nil {
+				at = binary.BigEndian.Uint64(v)
+			}
+			series = append(series, usage{id: string(k), used: at, bytes: bytes})
+			live += bytes
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Slice(series, func(i, j int) bool {
+			return series[i].used < series[j].used
+		})
+		target := int(float64(s.maxBytes) * DISK_CACHE_LOW_WATER)
+		for _, u := range series {
+			if live <= target {
+				break
+			}
+			if err := points.DeleteBucket([]byte(u.id)); err != nil {
+				return err
+			}
+			tx.Bucket(BUCKET_COVERAGE).Delete([]byte(u.id))
+			used.Delete([]byte(u.id))
+			live -= u.bytes
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.compact()
+}
+
+// Drop every persisted series and metadata response.
+func (s *diskStore) purge() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usedMu.Lock()
+	clear(s.used)
+	s.usedMu.Unlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{BUCKET_COVERAGE, BUCKET_POINTS, BUCKET_USED, BUCKET_THINGS, BUCKET_DATASTREAMS} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.compact()
+}
+
+// Rewrite the file without free pages. Callers hold the write lock.
+func (s *diskStore) compact() error {
+	tmp := s.path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, s.db, 1<<20); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	dst.Close()
+	s.db.Close()
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+	}
+	return s.open()
+}
+
+// Fill in the memory cache from persisted observations covering the range.
+func (d *Datasource) promoteObservations(id string, want timeInterval) error {
+	if d.diskStore == nil || d.observationCache == nil {
+		return nil
+	}
+	if len(d.observationCache.missing(id, want)) == 0 {
+		return nil
+	}
+	covered, points, err := d.diskStore.load(id, want)
+	if err != nil {
+		return err
+	}
+	for _, interval := range covered {
+		d.observationCache.store(id, interval, points)
+	}
+	return nil
+}
+
+// Seed the metadata caches with persisted responses, keeping the
+// original fetch time so that stale entries are refetched.
+func (d *Datasource) loadMetadata() error {
+	if d.diskStore == nil || d.metadata == nil || d.metadata.things == nil {
+		return nil
+	}
+	things, err := d.diskStore.metadata(BUCKET_THINGS)
+	if err != nil {
+		return err
+	}
+	for key, entry := range things {
+		var value []models.ThingWithLocation
+		if json.Unmarshal(entry.Value, &value) == nil {
+			d.metadata.things.seed(key, value, entry.Fetched)
+		}
+	}
+	dataStreams, err := d.diskStore.metadata(BUCKET_DATASTREAMS)
+	if err != nil {
+		return err
+	}
+	for key, entry := range dataStreams {
+		var value []models.DataStream
+		if json.Unmarshal(entry.Value, &value) == nil {
+			d.metadata.dataStreams.seed(key, value, entry.Fetched)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+func TestDiskStoreSurvivesRestart(t *testing.T) {
+	t.Setenv(DATA_PATH_ENV, t.TempDir())
+	config := &models.PluginSettings{}
+	store, err := acquireDiskStore(config, "uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour).UnixMilli()
+	fetched := timeInterval{From: old - 1000, Until: time.Now().UnixMilli()}
+	obs := []models.Observation{{Value: 1.5, PhenomenonTime: old}, {Value: 2, PhenomenonTime: time.Now().UnixMilli() - 1}}
+	if err := store.store("7", fetched, obs); err != nil {
+		t.Fatal(err)
+	}
+	store.release()
+
+	store, err = acquireDiskStore(config, "uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.release()
+	covered, points, err := store.load("7", fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(covered) != 1 || covered[0].Until >= time.Now().Add(-DISK_CACHE_AGE).UnixMilli()+1 {
+		t.Fatal("recent data should not be persisted, covered =", covered)
+	}
+	if len(points) != 1 || points[0].Value != 1.5 {
+		t.Fatal("points =", points)
+	}
+}
+
+func TestDiskStoreNeedsDataPath(t *testing.T) {
+	t.Setenv(DATA_PATH_ENV, "")
+	if _, err := acquireDiskStore(&models.PluginSettings{}, "uid"); err == nil {
+		t.Fatal("opened a cache without a Grafana data directory")
+	}
+	t.Setenv(DATA_PATH_ENV, t.TempDir())
+	if _, err := acquireDiskStore(&models.PluginSettings{}, "../uid"); err == nil {
+		t.Fatal("opened a cache outside the plugin directory")
+	}
+}
+
+func TestDiskCacheWithoutDataPath(t *testing.T) {
+	t.Setenv(DATA_PATH_ENV, "")
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		UID:                     "uid",
+		JSONData:                []byte(`{"serverUrl": "https://cloud.xylem.com", "authMethod": "xCloud", "diskCache": true}`),
+		DecryptedSecureJSONData: map[string]string{"secretKey": "c2VjcmV0", "clientId": "client"},
+	})
+	if err != nil {
+		t.Fatal("datasource should fall back to caching in memory,", err)
+	}
+	ds := instance.(*Datasource)
+	defer ds.Dispose()
+	if ds.diskStore != nil || ds.observationCache == nil {
+		t.Fatal("disk store =", ds.diskStore)
+	}
+}
+
+func TestDiskStorePurge(t *testing.T) {
+	t.Setenv(DATA_PATH_ENV, t.TempDir())
+	store, err := acquireDiskStore(&models.PluginSettings{}, "uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.release()
+	old := time.Now().Add(-48 * time.Hour).UnixMilli()
+	fetched := timeInterval{From: old - 1000, Until: old}
+	if err := store.store("7", fetched, []models.Observation{{Value: 1, PhenomenonTime: old}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.purge(); err != nil {
+		t.Fatal(err)
+	}
+	if covered, _, _ := store.load("7", fetched); len(covered) != 0 {
+		t.Fatal("covered after purge =", covered)
+	}
+}
+
+func TestDiskStoreSharedBetweenInstances(t *testing.T) {
+	t.Setenv(DATA_PATH_ENV, t.TempDir())
+	config := &models.PluginSettings{}
+	first, err := acquireDiskStore(config, "uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := acquireDiskStore(config, "uid")
+	if err != nil {
+		t.Fatal("replacement instance could not open the cache:", err)
+	}
+	first.release()
+	if _, _, err := second.load("7", timeInterval{From: 0, Until: 1}); err != nil {
+		t.Fatal("store closed while still in use:", err)
+	}
+	second.release()
+}
+
+func TestDiskStoreEnforcesSizeCap(t *testing.T) {
+	t.Setenv(DATA_PATH_ENV, t.TempDir())
+	config := &models.PluginSettings{DiskCacheMaxMb: 1}
+	store, err := acquireDiskStore(config, "uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.release()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	start := now.Add(-365 * 24 * time.Hour).UnixMilli()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		now = now.Add(time.Second)
+		obs := make([]models.Observation, 8000)
+		for i := range obs {
+			obs[i] = models.Observation{Value: float64(i), PhenomenonTime: start + int64(i)}
+		}
+		if err := store.store(id, timeInterval{From: start, Until: start + int64(len(obs))}, obs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size := store.size(); size > 1<<20 {
+		t.Fatal("file size =", size)
+	}
+	covered, _, _ := store.load("d", timeInterval{From: start, Until: start + 1})
+	if len(covered) == 0 {
+		t.Fatal("most recently used series evicted")
+	}
+}
+
+func TestMetadataRestoredFromDisk(t *testing.T) {
+	var requests atomic.Int32
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		json.NewEncoder(w).Encode([]models.DataStream{{Id: "1"}})
+	}))
+	t.Setenv(DATA_PATH_ENV, t.TempDir())
+	ds.metadata = newMetadataCache(ds.Config)
+	store, err := acquireDiskStore(ds.Config, "uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.diskStore = store
+	if _, err := ds.dataStreams(context.Background(), "site"); err != nil {
+		t.Fatal(err)
+	}
+	store.release()
+
+	restarted := newTestDatasource(t, nil)
+	restarted.Config = ds.Config
+	restarted.metadata = newMetadataCache(ds.Config)
+	restarted.diskStore, err = acquireDiskStore(ds.Config, "uid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.diskStore.release()
+	if err := restarted.loadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	dataStreams, err := restarted.dataStreams(context.Background(), "site")
+	if err != nil || len(dataStreams) != 1 {
+		t.Fatal("restored datastreams =", dataStreams, err)
+	}
+	if requests.Load() != 1 {
+		t.Fatal("requests =", requests.Load())
+	}
+}
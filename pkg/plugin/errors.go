@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Longest upstream message passed on to users.
+const UPSTREAM_MESSAGE_LENGTH = 200
+
+// Grafana status and error source of a failure in the query pipeline. The
+// vendor API and the network are downstream, while failing to sign a request
+// or decode a successful response is the plugin's fault. A cancelled request
+// was abandoned by its caller, which the SDK also counts as downstream, and
+// is kept out of timeouts.
+func classifyError(err error) (backend.Status, backend.ErrorSource) {
+	if errors.Is(err, context.Canceled) {
+		return backend.StatusUnknown, backend.ErrorSourceDownstream
+	}
+	var limited *rateLimitError
+	if errors.As(err, &limited) {
+		return backend.StatusTooManyRequests, backend.ErrorSourceDownstream
+	}
+	if errors.Is(err, errRequestTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return backend.StatusTimeout, backend.ErrorSourceDownstream
+	}
+	var upstream *upstreamError
+	if errors.As(err, &upstream) {
+		return upstreamStatus(upstream.StatusCode), backend.ErrorSourceDownstream
+	}
+	if !backend.IsDownstreamError(err) {
+		return backend.StatusInternal, backend.ErrorSourcePlugin
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return backend.StatusTimeout, backend.ErrorSourceDownstream
+	}
+	return backend.StatusBadGateway, backend.ErrorSourceDownstream
+}
+
+// Grafana status for a response status of the vendor API.
+func upstreamStatus(code int) backend.Status {
+	switch {
+	case code == http.StatusUnauthorized:
+		return backend.StatusUnauthorized
+	case code == http.StatusForbidden:
+		return backend.StatusForbidden
+	case code == http.StatusNotFound:
+		return backend.StatusNotFound
+	case code == http.StatusTooManyRequests:
+		return backend.StatusTooManyRequests
+	case code == http.StatusGatewayTimeout || code == http.StatusRequestTimeout:
+		return backend.StatusTimeout
+	case code >= 500:
+		return backend.StatusBadGateway
+	}
+	return backend.StatusBadRequest
+}
+
+// Short, printable message from an upstream error body. JSON bodies are
+// reduced to their message field, and markup or long bodies are cut short.
+func sanitizeUpstreamMessage(body string) string {
+	var payload struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if json.Unmarshal([]byte(body), &payload) == nil {
+		if payload.Message != "" {
+			body = payload.Message
+		} else if payload.Error != "" {
+			body = payload.Error
+		}
+	}
+	if strings.HasPrefix(strings.TrimSpace(body), "<") {
+		return ""
+	}
+	body = strings.Join(strings.FieldsFunc(body, func(r rune) bool {
+		return unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}), " ")
+	if runes := []rune(body); len(runes) > UPSTREAM_MESSAGE_LENGTH {
+		body = string(runes[:UPSTREAM_MESSAGE_LENGTH]) + "…"
+	}
+	return body
+}
+
+// Status of the response, with the sanitized upstream message when there is one.
+func (e *upstreamError) Error() string {
+	message := fmt.Sprintf("upstream responded %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if sanitized := sanitizeUpstreamMessage(e.Body); sanitized != "" {
+		message += ": " + sanitized
+	}
+	return message
+}
@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"golang.org/x/sync/semaphore"
+)
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err    error
+		status backend.Status
+		source backend.ErrorSource
+	}{
+		{backend.DownstreamError(&upstreamError{StatusCode: 401}), backend.StatusUnauthorized, backend.ErrorSourceDownstream},
+		{backend.DownstreamError(&upstreamError{StatusCode: 404}), backend.StatusNotFound, backend.ErrorSourceDownstream},
+		{backend.DownstreamError(&upstreamError{StatusCode: 503}), backend.StatusBadGateway, backend.ErrorSourceDownstream},
+		{backend.DownstreamError(&upstreamError{StatusCode: 504}), backend.StatusTimeout, backend.ErrorSourceDownstream},
+		{backend.DownstreamError(&upstreamError{StatusCode: 422}), backend.StatusBadRequest, backend.ErrorSourceDownstream},
+		{backend.DownstreamError(&rateLimitError{Wait: time.Second}), backend.StatusTooManyRequests, backend.ErrorSourceDownstream},
+		{backend.DownstreamErrorf("%w after 1m0s", errRequestTimeout), backend.StatusTimeout, backend.ErrorSourceDownstream},
+		{backend.DownstreamErrorf("request failed: %w", errors.New("connection refused")), backend.StatusBadGateway, backend.ErrorSourceDownstream},
+		{backend.PluginErrorf("unmarshal: %w", errors.New("unexpected end of JSON input")), backend.StatusInternal, backend.ErrorSourcePlugin},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), backend.StatusTimeout, backend.ErrorSourceDownstream},
+		{fmt.Errorf("wrapped: %w", context.Canceled), backend.StatusUnknown, backend.ErrorSourceDownstream},
+		{backend.DownstreamErrorf("request failed: %w", context.Canceled), backend.StatusUnknown, backend.ErrorSourceDownstream},
+	}
+	for _, c := range cases {
+		status, source := classifyError(c.err)
+		if status != c.status || source != c.source {
+			t.Errorf("%v: got %v %v, expected %v %v", c.err, status, source, c.status, c.source)
+		}
+	}
+}
+
+func TestSanitizeUpstreamMessage(t *testing.T) {
+	cases := map[string]string{
+		`{"message": "invalid signature"}`:              "invalid signature",
+		`{"error": "unknown site"}`:                     "unknown site",
+		"<html><body>Bad Gateway</body></html>":         "",
+		"line one\n\tline two\x00":                      "line one line two",
+		strings.Repeat("x", UPSTREAM_MESSAGE_LENGTH+50): strings.Repeat("x", UPSTREAM_MESSAGE_LENGTH) + "…",
+	}
+	for body, expected := range cases {
+		if message := sanitizeUpstreamMessage(body); message != expected {
+			t.Errorf("%q: got %q, expected %q", body, message, expected)
+		}
+	}
+}
+
+func TestQueryErrorStatus(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message": "invalid signature"}`))
+	}))
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(`{"thingId": "site"}`)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := resp.Responses["A"]
+	if result.Status != backend.StatusUnauthorized || result.ErrorSource != backend.ErrorSourceDownstream {
+		t.Fatal("expected a downstream unauthorized error, got", result.Status, result.ErrorSource)
+	}
+	if !strings.Contains(result.Error.Error(), "invalid signature") {
+		t.Fatal("expected the upstream message, got", result.Error)
+	}
+}
+
+func TestQuerySlotWaitIsPluginError(t *testing.T) {
+	ds := newTestDatasource(t, nil)
+	ds.queries = semaphore.NewWeighted(1)
+	ds.queries.Acquire(context.Background(), 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	resp, err := ds.QueryData(ctx, &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(`{"thingId": "site"}`)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := resp.Responses["A"]
+	if result.Status != backend.StatusTimeout || result.ErrorSource != backend.ErrorSourcePlugin {
+		t.Fatal("expected a plugin timeout, got", result.Status, result.ErrorSource)
+	}
+}
+
+func TestCallResourceErrorStatus(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	recorder := &resourceRecorder{}
+	err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "sites"}, recorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder.response.Status != http.StatusNotFound {
+		t.Fatal("expected upstream not found to be passed on, got", recorder.response.Status)
+	}
+}
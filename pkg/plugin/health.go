@@ -0,0 +1,225 @@
+package plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Largest difference from the server clock before signatures may be rejected.
+const CLOCK_SKEW_LIMIT = 5 * time.Minute
+// Time range of the observations sampled by the health check.
+const HEALTH_SAMPLE_RANGE = time.Hour
+// Status of a health check stage that passed.
+const STAGE_OK = "ok"
+// Status of a health check stage that failed.
+const STAGE_ERROR = "error"
+// Status of a health check stage not run because an earlier one failed.
+const STAGE_SKIPPED = "skipped"
+
+// Outcome of one step of the health check, as reported in the JSON details.
+type healthStage struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latencyMs"`
+	Message   string `json:"message,omitempty"`
+	// Things, datastreams or observations found, for stages that count them
+	Count *int `json:"count,omitempty"`
+}
+
+// Stages of a health check, run in order until one fails.
+type healthCheck struct {
+	Stages []healthStage `json:"stages"`
+	// One line per stage, shown by Grafana below the result
+	VerboseMessage string `json:"verboseMessage"`
+	failed         *healthStage
+}
+
+// Run a stage, or skip it after an earlier failure. The stage returns a
+// count when it has one, and a message to show either way.
+func (h *healthCheck) run(ctx context.Context, d *Datasource, name string, stage func(context.Context) (*int, string, error)) {
+	if h.failed != nil {
+		h.Stages = append(h.Stages, healthStage{Name: name, Status: STAGE_SKIPPED})
+		return
+	}
+	ctx, span := startSpan(ctx, "health "+name)
+	defer span.End()
+	start := time.Now()
+	count, message, err := stage(ctx)
+	result := healthStage{
+		Name:      name,
+		Status:    STAGE_OK,
+		LatencyMs: time.Since(start).Milliseconds(),
+		Message:   message,
+		Count:     count,
+	}
+	if err != nil {
+		spanError(span, err)
+		d.log(ctx).Warn("Health check stage failed", "stage", name, "error", err)
+		result.Status = STAGE_ERROR
+		result.Message = err.Error()
+	}
+	h.Stages = append(h.Stages, result)
+	if err != nil {
+		h.failed = &result
+	}
+}
+
+// Result for Grafana, naming the first stage that failed.
+func (h *healthCheck) result() *backend.CheckHealthResult {
+	lines := make([]string, len(h.Stages))
+	for i, stage := range h.Stages {
+		lines[i] = fmt.Sprintf("%s: %s", stage.Name, stage.Status)
+		if stage.Status != STAGE_SKIPPED {
+			lines[i] += fmt.Sprintf(" in %dms", stage.LatencyMs)
+		}
+		if stage.Message != "" {
+			lines[i] += ", " + stage.Message
+		}
+	}
+	h.VerboseMessage = strings.Join(lines, "\n")
+	details, _ := json.Marshal(h)
+	if h.failed != nil {
+		return &backend.CheckHealthResult{
+			Status:      backend.HealthStatusError,
+			Message:     fmt.Sprintf("%s check failed: %s", h.failed.Name, h.failed.Message),
+			JSONDetails: details,
+		}
+	}
+	return &backend.CheckHealthResult{
+		Status:      backend.HealthStatusOk,
+		Message:     "Data source is working",
+		JSONDetails: details,
+	}
+}
+
+// Resolve the server host and make an unsigned request to it, so network
+// and TLS problems are told apart from authentication problems. Any
+// response counts, and its Date header is returned for the clock check.
+func (d *Datasource) checkReachability(ctx context.Context) (int, string, string, error) {
+	server, err := url.Parse(d.Config.ServerUrl)
+	if err != nil || server.Hostname() == "" {
+		return 0, "", "", fmt.Errorf("invalid server URL %q", d.Config.ServerUrl)
+	}
+	addresses := []string{server.Hostname()}
+	if net.ParseIP(server.Hostname()) == nil {
+		addresses, err = net.DefaultResolver.LookupHost(ctx, server.Hostname())
+		if err != nil {
+			return 0, "", "", fmt.Errorf("resolving %s: %w", server.Hostname(), err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", d.Config.ServerUrl, nil)
+	if err != nil {
+		return 0, "", "", err
+	}
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return len(addresses), "", "", fmt.Errorf("connecting to %s: %w", server.Host, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	message := fmt.Sprintf("resolved %d addresses, server responded %d", len(addresses), resp.StatusCode)
+	if resp.TLS != nil {
+		message += " over " + tls.VersionName(resp.TLS.Version)
+	}
+	return len(addresses), message, resp.Header.Get("Date"), nil
+}
+
+// Compare the local clock with the time reported by the server, since the
+// signature covers the time of the request.
+func checkClockSkew(header string, now time.Time) (string, error) {
+	if header == "" {
+		return "server did not report its time", nil
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return fmt.Sprintf("server reported an unreadable time %q", header), nil
+	}
+	skew := now.Sub(date).Round(time.Second)
+	if skew.Abs() > CLOCK_SKEW_LIMIT {
+		return "", fmt.Errorf("local clock differs from the server by %s, signed requests may be rejected", skew)
+	}
+	return fmt.Sprintf("local clock differs from the server by %s", skew), nil
+}
+
+// CheckHealth handles health checks sent from Grafana to the plugin.
+// The main use case for these health checks is the test button on the
+// datasource configuration page which allows users to verify that
+// a datasource is working as expected. Each stage is reported in the
+// JSON details, so the first broken step can be found.
+func (d *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+	ctx, span := startSpan(ctx, "CheckHealth")
+	defer span.End()
+	check := &healthCheck{}
+	var serverDate string
+	var things []models.ThingWithLocation
+	var dataStreams []models.DataStream
+	check.run(ctx, d, "settings", func(ctx context.Context) (*int, string, error) {
+		return nil, "", d.settingsErr
+	})
+	check.run(ctx, d, "reachability", func(ctx context.Context) (*int, string, error) {
+		addresses, message, date, err := d.checkReachability(ctx)
+		serverDate = date
+		return &addresses, message, err
+	})
+	check.run(ctx, d, "clock", func(ctx context.Context) (*int, string, error) {
+		message, err := checkClockSkew(serverDate, time.Now())
+		return nil, message, err
+	})
+	check.run(ctx, d, "index", func(ctx context.Context) (*int, string, error) {
+		// Bypass the metadata cache, so the credentials are really tried
+		body, err := d.get(ctx, d.apiPath(INDEX_NAME))
+		if err != nil {
+			return nil, "", fmt.Errorf("request failed: %w", err)
+		}
+		err = json.Unmarshal(body, &things)
+		if err != nil {
+			return nil, "", fmt.Errorf("unmarshaling failed: %w", err)
+		}
+		count := len(things)
+		if count == 0 {
+			return &count, "", errors.New("no root nodes found")
+		}
+		return &count, fmt.Sprintf("found %d things", count), nil
+	})
+	check.run(ctx, d, "datastreams", func(ctx context.Context) (*int, string, error) {
+		var err error
+		dataStreams, err = d.fetchDataStreams(ctx, things[0].Id)
+		if err != nil {
+			return nil, "", fmt.Errorf("listing datastreams of %s: %w", things[0].Id, err)
+		}
+		count := len(dataStreams)
+		return &count, fmt.Sprintf("found %d datastreams of %s", count, things[0].Id), nil
+	})
+	check.run(ctx, d, "observations", func(ctx context.Context) (*int, string, error) {
+		if len(dataStreams) == 0 {
+			return nil, "no datastreams to sample", nil
+		}
+		id := dataStreams[0].Id
+		until := time.Now()
+		series, failed, err := d.fetchObservations(ctx, []string{id}, until.Add(-HEALTH_SAMPLE_RANGE), until)
+		if err == nil {
+			err = failed[id]
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("fetching observations of %s: %w", id, err)
+		}
+		count := len(series[id])
+		return &count, fmt.Sprintf("found %d observations of %s in the last %s", count, id, HEALTH_SAMPLE_RANGE), nil
+	})
+	span.SetAttributes(attribute.Bool("hmac.healthy", check.failed == nil))
+	return check.result(), nil
+}
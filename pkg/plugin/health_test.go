@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Stages reported in the JSON details of a health check.
+func healthStages(t *testing.T, res *backend.CheckHealthResult) map[string]healthStage {
+	var details healthCheck
+	if err := json.Unmarshal(res.JSONDetails, &details); err != nil {
+		t.Fatal(err)
+	}
+	stages := make(map[string]healthStage)
+	for _, stage := range details.Stages {
+		stages[stage.Name] = stage
+	}
+	if len(stages) != 6 {
+		t.Fatal("stages =", details.Stages)
+	}
+	return stages
+}
+
+func TestCheckHealthStages(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/sites":
+			w.Write([]byte(`[{"id": "site"}, {"id": "other"}]`))
+		case strings.HasSuffix(r.URL.Path, "/datastreams"):
+			w.Write([]byte(`[{"id": "1", "name": "temperature"}]`))
+		case r.URL.Path == "/api/observations":
+			w.Write([]byte(`{"1": [{"value": 1, "phenomenonTime": 0}, {"value": 2, "phenomenonTime": 1}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != backend.HealthStatusOk {
+		t.Fatal(res.Message)
+	}
+	stages := healthStages(t, res)
+	for name, want := range map[string]int{"index": 2, "datastreams": 1, "observations": 2} {
+		stage := stages[name]
+		if stage.Status != STAGE_OK || stage.Count == nil || *stage.Count != want {
+			t.Fatal(name, "stage =", stage)
+		}
+	}
+}
+
+func TestCheckHealthNamesFailedStage(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/sites" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message": "invalid signature"}`))
+		}
+	}))
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != backend.HealthStatusError || !strings.HasPrefix(res.Message, "index check failed") || !strings.Contains(res.Message, "invalid signature") {
+		t.Fatal("message =", res.Message)
+	}
+	stages := healthStages(t, res)
+	if stages["reachability"].Status != STAGE_OK || stages["index"].Status != STAGE_ERROR {
+		t.Fatal("stages =", stages)
+	}
+	if stages["datastreams"].Status != STAGE_SKIPPED || stages["observations"].Status != STAGE_SKIPPED {
+		t.Fatal("stages after a failure should be skipped, got", stages)
+	}
+}
+
+func TestCheckHealthInvalidSettings(t *testing.T) {
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData:                []byte(`{"serverUrl": "https://cloud.xylem.com"}`),
+		DecryptedSecureJSONData: map[string]string{"secretKey": "c2VjcmV0", "clientId": "client"},
+	})
+	if err != nil {
+		t.Fatal("invalid settings should still load,", err)
+	}
+	ds := instance.(*Datasource)
+	defer ds.Dispose()
+	res, _ := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if res.Message != "settings check failed: authMethod is missing" {
+		t.Fatal("message =", res.Message)
+	}
+	stages := healthStages(t, res)
+	if stages["settings"].Status != STAGE_ERROR || stages["reachability"].Status != STAGE_SKIPPED {
+		t.Fatal("stages =", stages)
+	}
+	resp, _ := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(`{"thingId": "site"}`)}},
+	})
+	if result := resp.Responses["A"]; result.ErrorSource != backend.ErrorSourceDownstream || !strings.Contains(result.Error.Error(), "authMethod is missing") {
+		t.Fatal("query =", result.Status, result.ErrorSource, result.Error)
+	}
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	now := time.Date(2025, 5, 25, 13, 0, 0, 0, time.UTC)
+	if _, err := checkClockSkew(now.Add(-time.Minute).Format(http.TimeFormat), now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkClockSkew(now.Add(10*time.Minute).Format(http.TimeFormat), now); err == nil {
+		t.Fatal("a clock ten minutes behind the server should fail")
+	}
+	if _, err := checkClockSkew("", now); err != nil {
+		t.Fatal("a missing Date header should not fail", err)
+	}
+}
@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Upstream request shared by every caller waiting for the same path. It
+// runs until it finishes or the last waiter leaves, so abandoned requests
+// stop retrying against the metered API.
+type sharedRequest struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	result fetchResult
+	err    error
+	// Deadline of each waiter, zero for waiters without one
+	waiters map[int]time.Time
+	next    int
+}
+
+// Requests in flight by path. The zero value is ready to use.
+type inflightRequests struct {
+	mu       sync.Mutex
+	requests map[string]*sharedRequest
+}
+
+// Wait for the request of a path, joining the one in flight or starting it.
+// The caller stops waiting when its own context is done, and the request is
+// cancelled when no caller is left waiting for it.
+func (f *inflightRequests) do(ctx context.Context, path string, fetch func(*sharedRequest) (fetchResult, error)) (fetchResult, error) {
+	request, id, started := f.join(ctx, path)
+	if started {
+		go func() {
+			result, err := fetch(request)
+			f.finish(path, request, result, err)
+		}()
+	}
+	defer f.leave(path, request, id)
+	select {
+	case <-ctx.Done():
+		return fetchResult{}, ctx.Err()
+	case <-request.done:
+		return request.result, request.err
+	}
+}
+
+// Register a waiter, creating the request when none is in flight. The
+// request keeps the values of the context that started it, such as the
+// trace, but not its cancellation.
+func (f *inflightRequests) join(ctx context.Context, path string) (*sharedRequest, int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.requests == nil {
+		f.requests = make(map[string]*sharedRequest)
+	}
+	request, ok := f.requests[path]
+	if !ok {
+		shared, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		request = &sharedRequest{ctx: shared, cancel: cancel, done: make(chan struct{}), waiters: make(map[int]time.Time)}
+		f.requests[path] = request
+	}
+	id := request.next
+	request.next++
+	deadline, _ := ctx.Deadline()
+	request.waiters[id] = deadline
+	return request, id, !ok
+}
+
+// Remove a waiter, cancelling the request when it was the last one.
+func (f *inflightRequests) leave(path string, request *sharedRequest, id int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(request.waiters, id)
+	if len(request.waiters) > 0 {
+		return
+	}
+	request.cancel()
+	if f.requests[path] == request {
+		delete(f.requests, path)
+	}
+}
+
+// Publish the outcome to the waiters.
+func (f *inflightRequests) finish(path string, request *sharedRequest, result fetchResult, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	request.result = result
+	request.err = err
+	close(request.done)
+	request.cancel()
+	if f.requests[path] == request {
+		delete(f.requests, path)
+	}
+}
+
+// Latest deadline of the callers still waiting, since waits ending before
+// it may still be of use to one of them. There is none while a waiter has
+// no deadline.
+func (f *inflightRequests) deadline(request *sharedRequest) (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var latest time.Time
+	for _, deadline := range request.waiters {
+		if deadline.IsZero() {
+			return time.Time{}, false
+		}
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+	return latest, !latest.IsZero()
+}
@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Verbosity used when the settings do not specify one.
+const LOG_LEVEL = "info"
+// Replacement for credentials in log output.
+const REDACTED = "[redacted]"
+
+// Log keys whose values are always replaced, compared case-insensitively.
+var redactedKeys = map[string]bool{
+	"authorization": true,
+	"secretkey":     true,
+	"clientid":      true,
+	"signature":     true,
+	"password":      true,
+}
+
+// Parse a verbosity name from the settings.
+func parseLogLevel(name string) (log.Level, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return parseLogLevel(LOG_LEVEL)
+	case "debug":
+		return log.Debug, nil
+	case "info":
+		return log.Info, nil
+	case "warn", "warning":
+		return log.Warn, nil
+	case "error":
+		return log.Error, nil
+	}
+	return log.NoLevel, fmt.Errorf("unknown log level %q", name)
+}
+
+// SDK logger of a datasource instance, dropping messages below the configured
+// verbosity and redacting credentials from messages and fields.
+type pluginLogger struct {
+	base    log.Logger
+	level   log.Level
+	secrets []string
+}
+
+// Logger for the settings of a datasource. Unknown verbosities fall back to
+// the default, since settings are validated separately.
+func newPluginLogger(base log.Logger, config *models.PluginSettings) *pluginLogger {
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		level, _ = parseLogLevel(LOG_LEVEL)
+	}
+	var secrets []string
+	if config.Secrets != nil {
+		for _, secret := range []string{
+			config.Secrets.SecretKey,
+			config.Secrets.ClientId,
+			base64.StdEncoding.EncodeToString([]byte(config.Secrets.ClientId)),
+		} {
+			if secret != "" {
+				secrets = append(secrets, secret)
+			}
+		}
+	}
+	return &pluginLogger{base: base, level: level, secrets: secrets}
+}
+
+// Remove credentials from text, such as an error echoing a request.
+func (l *pluginLogger) scrub(text string) string {
+	for _, secret := range l.secrets {
+		text = strings.ReplaceAll(text, secret, REDACTED)
+	}
+	return text
+}
+
+// Copy of key-value pairs with credentials removed.
+func (l *pluginLogger) redact(args []interface{}) []interface{} {
+	result := make([]interface{}, len(args))
+	for i, arg := range args {
+		if i%2 == 1 {
+			if key, ok := args[i-1].(string); ok && redactedKeys[strings.ToLower(key)] {
+				result[i] = REDACTED
+				continue
+			}
+		}
+		switch value := arg.(type) {
+		case string:
+			result[i] = l.scrub(value)
+		case error:
+			result[i] = l.scrub(value.Error())
+		case fmt.Stringer:
+			result[i] = l.scrub(value.String())
+		default:
+			result[i] = arg
+		}
+	}
+	return result
+}
+
+func (l *pluginLogger) Debug(msg string, args ...interface{}) {
+	if l.level <= log.Debug {
+		l.base.Debug(l.scrub(msg), l.redact(args)...)
+	}
+}
+
+func (l *pluginLogger) Info(msg string, args ...interface{}) {
+	if l.level <= log.Info {
+		l.base.Info(l.scrub(msg), l.redact(args)...)
+	}
+}
+
+func (l *pluginLogger) Warn(msg string, args ...interface{}) {
+	if l.level <= log.Warn {
+		l.base.Warn(l.scrub(msg), l.redact(args)...)
+	}
+}
+
+func (l *pluginLogger) Error(msg string, args ...interface{}) {
+	l.base.Error(l.scrub(msg), l.redact(args)...)
+}
+
+func (l *pluginLogger) With(args ...interface{}) log.Logger {
+	return &pluginLogger{base: l.base.With(l.redact(args)...), level: l.level, secrets: l.secrets}
+}
+
+func (l *pluginLogger) Level() log.Level {
+	return max(l.level, l.base.Level())
+}
+
+func (l *pluginLogger) FromContext(ctx context.Context) log.Logger {
+	return &pluginLogger{base: l.base.FromContext(ctx), level: l.level, secrets: l.secrets}
+}
+
+// Logger for a request, carrying the SDK context fields such as the
+// endpoint, datasource and trace id.
+func (d *Datasource) log(ctx context.Context) log.Logger {
+	logger := d.logger
+	if logger == nil {
+		config := d.Config
+		if config == nil {
+			config = &models.PluginSettings{}
+		}
+		logger = newPluginLogger(log.DefaultLogger, config)
+	}
+	return logger.FromContext(ctx)
+}
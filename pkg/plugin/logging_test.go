@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Logger keeping formatted messages in memory.
+type memoryLogger struct {
+	lines *[]string
+}
+
+func (l memoryLogger) write(level string, msg string, args ...interface{}) {
+	*l.lines = append(*l.lines, fmt.Sprint(level, " ", msg, " ", args))
+}
+
+func (l memoryLogger) Debug(msg string, args ...interface{})  { l.write("debug", msg, args...) }
+func (l memoryLogger) Info(msg string, args ...interface{})   { l.write("info", msg, args...) }
+func (l memoryLogger) Warn(msg string, args ...interface{})   { l.write("warn", msg, args...) }
+func (l memoryLogger) Error(msg string, args ...interface{})  { l.write("error", msg, args...) }
+func (l memoryLogger) With(args ...interface{}) log.Logger    { return l }
+func (l memoryLogger) Level() log.Level                       { return log.Debug }
+func (l memoryLogger) FromContext(context.Context) log.Logger { return l }
+
+func TestLoggerRedactsCredentials(t *testing.T) {
+	var lines []string
+	logger := newPluginLogger(memoryLogger{&lines}, &models.PluginSettings{
+		LogLevel: "debug",
+		Secrets:  &models.SecretPluginSettings{SecretKey: "c2VjcmV0", ClientId: "client-123"},
+	})
+	logger.FromContext(context.Background()).Info("Signing with c2VjcmV0",
+		"Authorization", "HMAC Y2xpZW50:abc",
+		"clientId", "client-123",
+		"error", errors.New("rejected client-123"),
+		"path", "/api/sites",
+	)
+	output := strings.Join(lines, "\n")
+	for _, secret := range []string{"c2VjcmV0", "client-123", "Y2xpZW50:abc"} {
+		if strings.Contains(output, secret) {
+			t.Fatal("log output contains a credential:", output)
+		}
+	}
+	if !strings.Contains(output, "/api/sites") {
+		t.Fatal("other fields should be kept:", output)
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	var lines []string
+	logger := newPluginLogger(memoryLogger{&lines}, &models.PluginSettings{LogLevel: "warn"})
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+	logger.Error("error")
+	if len(lines) != 2 {
+		t.Fatal("only warnings and errors should be logged, got", lines)
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Fatal("unknown level should be rejected")
+	}
+	if level, _ := parseLogLevel(""); level != log.Info {
+		t.Fatal("default level should be info, got", level)
+	}
+}
@@ -0,0 +1,138 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Lifetime of cached things and datastreams, unless configured.
+const METADATA_TTL = 5 * time.Minute
+// Fraction of the lifetime after which a hit also refreshes the entry
+// in the background, so that busy entries never expire.
+const METADATA_REFRESH = 0.75
+
+// Value fetched from the vendor API, and when.
+type cacheEntry[T any] struct {
+	value      T
+	fetched    time.Time
+	refreshing bool
+}
+
+// Cache of slowly changing API responses with a fixed time to live. A nil
+// cache passes every call through to the fetch function.
+type ttlCache[T any] struct {
+	// Cache label of lookup metrics
+	name    string
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*cacheEntry[T]
+	now     func() time.Time
+}
+
+func newTTLCache[T any](name string, ttl time.Duration) *ttlCache[T] {
+	return &ttlCache[T]{
+		name:    name,
+		ttl:     ttl,
+		entries: make(map[string]*cacheEntry[T]),
+		now:     time.Now,
+	}
+}
+
+// Cached value for the key, fetching it when missing or expired. Entries
+// past the refresh point are returned immediately and refetched in the
+// background.
+func (c *ttlCache[T]) get(ctx context.Context, key string, fetch func(context.Context) (T, error)) (T, error) {
+	if c == nil {
+		return fetch(ctx)
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	now := c.now()
+	hit := ok && now.Sub(entry.fetched) < c.ttl
+	observeCache(c.name, hit)
+	if hit {
+		if !entry.refreshing && now.Sub(entry.fetched) > time.Duration(float64(c.ttl)*METADATA_REFRESH) {
+			entry.refreshing = true
+			go c.refresh(context.WithoutCancel(ctx), key, entry, fetch)
+		}
+		value := entry.value
+		c.mu.Unlock()
+		return value, nil
+	}
+	c.mu.Unlock()
+	value, err := fetch(ctx)
+	if err != nil {
+		return value, err
+	}
+	c.mu.Lock()
+	c.entries[key] = &cacheEntry[T]{value: value, fetched: c.now()}
+	c.mu.Unlock()
+	return value, nil
+}
+
+// Replace an entry with a fresh value, keeping the old one on failure.
+func (c *ttlCache[T]) refresh(ctx context.Context, key string, entry *cacheEntry[T], fetch func(context.Context) (T, error)) {
+	value, err := fetch(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.refreshing = false
+	if err != nil || c.entries[key] != entry {
+		return
+	}
+	c.entries[key] = &cacheEntry[T]{value: value, fetched: c.now()}
+}
+
+// Add an entry fetched at an earlier time, such as one persisted before a restart.
+func (c *ttlCache[T]) seed(key string, value T, fetched time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &cacheEntry[T]{value: value, fetched: fetched}
+}
+
+// Drop all entries.
+func (c *ttlCache[T]) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*cacheEntry[T])
+}
+
+// Things and datastreams, including units of measurement, cached per
+// datasource instance.
+type metadataCache struct {
+	things      *ttlCache[[]models.ThingWithLocation]
+	dataStreams *ttlCache[[]models.DataStream]
+}
+
+// Metadata cache for the configured lifetime. Caching is disabled when
+// the lifetime is negative.
+func newMetadataCache(config *models.PluginSettings) *metadataCache {
+	ttl := time.Duration(config.MetadataTtl) * time.Second
+	if config.MetadataTtl == 0 {
+		ttl = METADATA_TTL
+	}
+	if ttl < 0 {
+		return &metadataCache{}
+	}
+	return &metadataCache{
+		things:      newTTLCache[[]models.ThingWithLocation]("things", ttl),
+		dataStreams: newTTLCache[[]models.DataStream]("datastreams", ttl),
+	}
+}
+
+// Drop all cached metadata.
+func (m *metadataCache) purge() {
+	if m == nil {
+		return
+	}
+	m.things.purge()
+	m.dataStreams.purge()
+}
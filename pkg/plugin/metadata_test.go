@@ -0,0 +1,92 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+func TestTTLCacheExpires(t *testing.T) {
+	now := time.Unix(0, 0)
+	cache := newTTLCache[int]("test", time.Minute)
+	cache.now = func() time.Time { return now }
+	fetches := 0
+	fetch := func(context.Context) (int, error) {
+		fetches++
+		return fetches, nil
+	}
+	cache.get(context.Background(), "k", fetch)
+	now = now.Add(30 * time.Second)
+	if v, _ := cache.get(context.Background(), "k", fetch); v != 1 {
+		t.Fatal("fresh entry refetched, value =", v)
+	}
+	now = now.Add(time.Minute)
+	if v, _ := cache.get(context.Background(), "k", fetch); v != 2 {
+		t.Fatal("expired entry served, value =", v)
+	}
+	cache.purge()
+	if v, _ := cache.get(context.Background(), "k", fetch); v != 3 {
+		t.Fatal("purged entry served, value =", v)
+	}
+}
+
+func TestTTLCacheRefreshesInBackground(t *testing.T) {
+	now := time.Unix(0, 0)
+	cache := newTTLCache[int]("test", time.Minute)
+	cache.now = func() time.Time { return now }
+	var fetches atomic.Int32
+	fetch := func(context.Context) (int, error) {
+		return int(fetches.Add(1)), nil
+	}
+	cache.get(context.Background(), "k", fetch)
+	now = now.Add(50 * time.Second)
+	if v, _ := cache.get(context.Background(), "k", fetch); v != 1 {
+		t.Fatal("stale entry should be served while refreshing, value =", v)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if v, _ := cache.get(context.Background(), "k", fetch); v == 2 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("entry was not refreshed")
+}
+
+func TestCallResourcePurgesCache(t *testing.T) {
+	var requests atomic.Int32
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`[]`))
+	}))
+	ds.metadata = newMetadataCache(&models.PluginSettings{})
+	list := &backend.CallResourceRequest{Path: "sites", Method: http.MethodGet}
+	ds.CallResource(context.Background(), list, &resourceRecorder{})
+	ds.CallResource(context.Background(), list, &resourceRecorder{})
+	if requests.Load() != 1 {
+		t.Fatal("cached listing refetched, requests =", requests.Load())
+	}
+	purge := &backend.CallResourceRequest{Path: RESOURCE_CACHE, Method: http.MethodDelete}
+	purge.PluginContext.User = &backend.User{Role: "Viewer"}
+	recorder := &resourceRecorder{}
+	ds.CallResource(context.Background(), purge, recorder)
+	if recorder.response.Status != http.StatusForbidden {
+		t.Fatal("viewer purge status =", recorder.response.Status)
+	}
+	purge.PluginContext.User = &backend.User{Role: ROLE_ADMIN}
+	recorder = &resourceRecorder{}
+	ds.CallResource(context.Background(), purge, recorder)
+	if recorder.response.Status != http.StatusNoContent {
+		t.Fatal("purge status =", recorder.response.Status)
+	}
+	ds.CallResource(context.Background(), list, &resourceRecorder{})
+	if requests.Load() != 2 {
+		t.Fatal("listing not refetched after purge, requests =", requests.Load())
+	}
+}
@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Namespace of the metrics exported through the plugin metrics endpoint.
+const METRICS_NAMESPACE = "hmac_datasource"
+// Endpoint label of requests listing things.
+const ENDPOINT_SITES = "sites"
+// Endpoint label of requests listing the datastreams of a thing.
+const ENDPOINT_DATASTREAMS = "datastreams"
+// Endpoint label of requests for observations.
+const ENDPOINT_OBSERVATIONS = "observations"
+
+// Metrics are registered with the default registry, which the SDK gathers
+// when Grafana collects plugin metrics.
+var (
+	upstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "upstream_requests_total",
+		Help:      "Upstream HTTP requests by endpoint kind and response status.",
+	}, []string{"endpoint", "status"})
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Latency of upstream HTTP requests by endpoint kind and response status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "status"})
+	upstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "upstream_retries_total",
+		Help:      "Upstream requests repeated after a transient failure or a request to slow down.",
+	}, []string{"endpoint", "reason"})
+	rateLimitWaits = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "rate_limit_wait_seconds",
+		Help:      "Time upstream requests waited for the rate limit or a Retry-After.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10, 30, 60},
+	})
+	rateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "rate_limited_total",
+		Help:      "Upstream requests refused because the wait would outlast the deadline.",
+	})
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "cache_lookups_total",
+		Help:      "Cache lookups by cache and result, hit or miss.",
+	}, []string{"cache", "result"})
+	mqttDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "mqtt_dropped_messages_total",
+		Help:      "Broker messages dropped because a live channel fell behind.",
+	})
+	signingFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "signing_failures_total",
+		Help:      "Upstream requests that could not be signed.",
+	})
+	queryBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "query_decoded_bytes",
+		Help:      "Response bytes decoded per query.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	queryPoints = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "query_decoded_points",
+		Help:      "Observations decoded per query.",
+		Buckets:   prometheus.ExponentialBuckets(10, 4, 10),
+	})
+)
+
+// Kind of API endpoint an upstream path belongs to, keeping label values few.
+func endpointKind(path string) string {
+	switch {
+	case strings.Contains(path, QUERY_PATH):
+		return ENDPOINT_OBSERVATIONS
+	case strings.HasSuffix(path, "/"+QUERY_COLLECTION):
+		return ENDPOINT_DATASTREAMS
+	}
+	return ENDPOINT_SITES
+}
+
+// Record an upstream request by its response status, or "error" when no
+// response arrived.
+func observeUpstream(path string, status int, elapsed time.Duration) {
+	label := "error"
+	if status > 0 {
+		label = strconv.Itoa(status)
+	}
+	kind := endpointKind(path)
+	upstreamRequests.WithLabelValues(kind, label).Inc()
+	upstreamDuration.WithLabelValues(kind, label).Observe(elapsed.Seconds())
+}
+
+// Record a cache lookup.
+func observeCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.WithLabelValues(cache, result).Inc()
+}
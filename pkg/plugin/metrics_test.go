@@ -0,0 +1,47 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+func TestEndpointKind(t *testing.T) {
+	cases := map[string]string{
+		"/api/sites":                          ENDPOINT_SITES,
+		"/api/site/1/datastreams":             ENDPOINT_DATASTREAMS,
+		"/api/observations?datastreamIds=1,2": ENDPOINT_OBSERVATIONS,
+	}
+	for path, expected := range cases {
+		if kind := endpointKind(path); kind != expected {
+			t.Errorf("%s: got %s, expected %s", path, kind, expected)
+		}
+	}
+}
+
+func TestUpstreamMetrics(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	ds.metadata = &metadataCache{things: newTTLCache[[]models.ThingWithLocation]("things", time.Minute)}
+	requests := testutil.ToFloat64(upstreamRequests.WithLabelValues(ENDPOINT_SITES, "200"))
+	hits := testutil.ToFloat64(cacheLookups.WithLabelValues("things", "hit"))
+	misses := testutil.ToFloat64(cacheLookups.WithLabelValues("things", "miss"))
+	for i := 0; i < 2; i++ {
+		if _, err := ds.things(context.Background(), "/api/sites"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if delta := testutil.ToFloat64(upstreamRequests.WithLabelValues(ENDPOINT_SITES, "200")) - requests; delta != 1 {
+		t.Fatal("expected one upstream request counted, got", delta)
+	}
+	if testutil.ToFloat64(cacheLookups.WithLabelValues("things", "hit"))-hits != 1 ||
+		testutil.ToFloat64(cacheLookups.WithLabelValues("things", "miss"))-misses != 1 {
+		t.Fatal("expected one cache miss followed by a hit")
+	}
+}
@@ -0,0 +1,376 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// SensorThings version prefix used when the settings do not specify one.
+const MQTT_TOPIC_PREFIX = "v1.1"
+// Time allowed for connecting to the broker and acknowledging subscriptions.
+const MQTT_TIMEOUT = 10 * time.Second
+
+// Receives raw messages published on MQTT topics. Implemented by the paho
+// client, and by stand-in brokers in tests.
+type mqttConnection interface {
+	Subscribe(topic string, handler func(payload []byte)) error
+	Unsubscribe(topic string) error
+	Close()
+}
+
+// SensorThings MQTT extension topic carrying new observations of a
+// datastream, mirroring the REST resource path. Ids that would change the
+// topic levels or match other topics are refused.
+func observationTopic(prefix string, dataStreamId string) (string, error) {
+	if dataStreamId == "" || strings.ContainsAny(dataStreamId, "+#/\x00") {
+		return "", fmt.Errorf("datastream id %q cannot be used in an mqtt topic", dataStreamId)
+	}
+	if prefix == "" {
+		prefix = MQTT_TOPIC_PREFIX
+	}
+	return prefix + "/Datastreams(" + dataStreamId + ")/Observations", nil
+}
+
+// Observation as published by SensorThings servers. Standard servers send
+// an ISO 8601 phenomenon time and a result, while the vendor API uses epoch
+// milliseconds and a value, so both are accepted.
+type mqttObservation struct {
+	PhenomenonTime json.RawMessage `json:"phenomenonTime"`
+	Result         *float64        `json:"result"`
+	Value          *float64        `json:"value"`
+}
+
+// Decode an MQTT message payload into an observation.
+func decodeMqttObservation(payload []byte) (models.Observation, error) {
+	var message mqttObservation
+	err := json.Unmarshal(payload, &message)
+	if err != nil {
+		return models.Observation{}, err
+	}
+	value := message.Value
+	if value == nil {
+		value = message.Result
+	}
+	if value == nil {
+		return models.Observation{}, fmt.Errorf("observation has no numeric result")
+	}
+	var millis int64
+	if err := json.Unmarshal(message.PhenomenonTime, &millis); err == nil {
+		return models.Observation{Value: *value, PhenomenonTime: millis}, nil
+	}
+	var iso string
+	err = json.Unmarshal(message.PhenomenonTime, &iso)
+	if err != nil {
+		return models.Observation{}, fmt.Errorf("phenomenonTime: %w", err)
+	}
+	// Intervals are reported at their end
+	if _, end, ok := strings.Cut(iso, "/"); ok {
+		iso = end
+	}
+	t, err := time.Parse(time.RFC3339Nano, iso)
+	if err != nil {
+		return models.Observation{}, fmt.Errorf("phenomenonTime: %w", err)
+	}
+	return models.Observation{Value: *value, PhenomenonTime: t.UnixMilli()}, nil
+}
+
+// Shares one broker connection between live channels, subscribing to each
+// topic once and fanning messages out to every listener.
+type mqttHub struct {
+	// Guards the listeners, and is never held while waiting on the broker
+	mu     sync.Mutex
+	conn   mqttConnection
+	topics map[string]*mqttTopic
+	next   int
+	// Orders subscribing and unsubscribing with the broker
+	brokerMu sync.Mutex
+}
+
+// Listeners of a topic, and the outcome of subscribing to it.
+type mqttTopic struct {
+	listeners map[int]func([]byte)
+	// Closed once the broker acknowledged or refused the subscription
+	ready chan struct{}
+	err   error
+}
+
+func newMqttHub(conn mqttConnection) *mqttHub {
+	return &mqttHub{
+		conn:   conn,
+		topics: make(map[string]*mqttTopic),
+	}
+}
+
+// Deliver a message to the current listeners of a topic.
+func (h *mqttHub) dispatch(topic string, payload []byte) {
+	h.mu.Lock()
+	var handlers []func([]byte)
+	if t, ok := h.topics[topic]; ok {
+		for _, handler := range t.listeners {
+			handlers = append(handlers, handler)
+		}
+	}
+	h.mu.Unlock()
+	for _, handler := range handlers {
+		handler(payload)
+	}
+}
+
+// Connection to the broker, once connected.
+func (h *mqttHub) connection() mqttConnection {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.conn
+}
+
+// Register a listener for a topic. The returned function removes it, and
+// unsubscribes from the broker when it was the last one.
+func (h *mqttHub) listen(topic string, handler func([]byte)) (func(), error) {
+	h.mu.Lock()
+	t, subscribed := h.topics[topic]
+	if !subscribed {
+		t = &mqttTopic{listeners: make(map[int]func([]byte)), ready: make(chan struct{})}
+		h.topics[topic] = t
+	}
+	id := h.next
+	h.next++
+	t.listeners[id] = handler
+	h.mu.Unlock()
+	remove := func() {
+		h.mu.Lock()
+		delete(t.listeners, id)
+		last := len(t.listeners) == 0 && h.topics[topic] == t
+		if last {
+			delete(h.topics, topic)
+		}
+		h.mu.Unlock()
+		if last {
+			h.unsubscribe(topic)
+		}
+	}
+	if !subscribed {
+		h.brokerMu.Lock()
+		t.err = h.connection().Subscribe(topic, func(payload []byte) {
+			h.dispatch(topic, payload)
+		})
+		h.brokerMu.Unlock()
+		close(t.ready)
+	}
+	<-t.ready
+	if t.err != nil {
+		remove()
+		return nil, t.err
+	}
+	return remove, nil
+}
+
+// Unsubscribe from a topic, unless a listener joined again meanwhile.
+func (h *mqttHub) unsubscribe(topic string) {
+	h.brokerMu.Lock()
+	defer h.brokerMu.Unlock()
+	h.mu.Lock()
+	_, listening := h.topics[topic]
+	h.mu.Unlock()
+	if !listening {
+		h.connection().Unsubscribe(topic)
+	}
+}
+
+// Subscribe again to every topic with listeners. A broker keeps no
+// subscriptions for a clean session, so they are lost on reconnecting.
+func (h *mqttHub) resubscribe() error {
+	h.brokerMu.Lock()
+	defer h.brokerMu.Unlock()
+	h.mu.Lock()
+	conn := h.conn
+	topics := make([]string, 0, len(h.topics))
+	for topic := range h.topics {
+		topics = append(topics, topic)
+	}
+	h.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	var errs []error
+	for _, topic := range topics {
+		err := conn.Subscribe(topic, func(payload []byte) {
+			h.dispatch(topic, payload)
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Disconnect from the broker.
+func (h *mqttHub) close() {
+	if conn := h.connection(); conn != nil {
+		conn.Close()
+	}
+}
+
+// Broker connection backed by the paho client.
+type pahoConnection struct {
+	client mqtt.Client
+}
+
+func (c *pahoConnection) Subscribe(topic string, handler func(payload []byte)) error {
+	token := c.client.Subscribe(topic, 0, func(_ mqtt.Client, message mqtt.Message) {
+		handler(message.Payload())
+	})
+	if !token.WaitTimeout(MQTT_TIMEOUT) {
+		return fmt.Errorf("subscribe to %s timed out", topic)
+	}
+	return token.Error()
+}
+
+func (c *pahoConnection) Unsubscribe(topic string) error {
+	token := c.client.Unsubscribe(topic)
+	token.WaitTimeout(MQTT_TIMEOUT)
+	return token.Error()
+}
+
+func (c *pahoConnection) Close() {
+	c.client.Disconnect(250)
+}
+
+// Connect to the broker configured in the plugin settings. The callbacks
+// run on every connection, including reconnects, and on losing it.
+func connectMqtt(config *models.PluginSettings, onConnect func(), onLost func(error)) (mqttConnection, error) {
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("client id: %w", err)
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(config.MqttBrokerUrl).
+		SetClientID("grafana-hmac-" + hex.EncodeToString(suffix)).
+		SetConnectTimeout(MQTT_TIMEOUT).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(func(mqtt.Client) { onConnect() }).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) { onLost(err) })
+	if config.MqttUsername != "" {
+		options.SetUsername(config.MqttUsername)
+		options.SetPassword(config.Secrets.MqttPassword)
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.MqttTlsSkipVerify}
+	if config.Secrets.MqttCaCert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(config.Secrets.MqttCaCert)) {
+			return nil, fmt.Errorf("mqtt CA certificate is not valid PEM")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	options.SetTLSConfig(tlsConfig)
+	client := mqtt.NewClient(options)
+	token := client.Connect()
+	if !token.WaitTimeout(MQTT_TIMEOUT) {
+		return nil, fmt.Errorf("connecting to %s timed out", config.MqttBrokerUrl)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return &pahoConnection{client: client}, nil
+}
+
+// Shared hub for the configured broker, connecting on first use.
+func (d *Datasource) mqttHub() (*mqttHub, error) {
+	d.mqttLock.Lock()
+	defer d.mqttLock.Unlock()
+	if d.mqtt != nil {
+		return d.mqtt, nil
+	}
+	hub := newMqttHub(nil)
+	logger := d.log(context.Background())
+	conn, err := connectMqtt(d.Config, func() {
+		if err := hub.resubscribe(); err != nil {
+			logger.Error("Resubscribing to broker topics failed", "error", err)
+		}
+	}, func(err error) {
+		logger.Warn("Broker connection lost, reconnecting", "error", err)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: %w", err)
+	}
+	hub.mu.Lock()
+	hub.conn = conn
+	hub.mu.Unlock()
+	d.mqtt = hub
+	return d.mqtt, nil
+}
+
+// Whether live channels are fed from a broker instead of polling.
+func (d *Datasource) usesMqtt() bool {
+	return d.Config.MqttBrokerUrl != ""
+}
+
+// Push observations arriving on the datastream topics to a live channel,
+// until the context is cancelled. Messages are dropped rather than queued
+// when the channel falls behind, so a slow client never stalls the broker
+// client's message router.
+func (d *Datasource) runMqttStream(ctx context.Context, thingId string, ids []string, lookup map[string]string, sender *backend.StreamSender) error {
+	hub, err := d.mqttHub()
+	if err != nil {
+		return err
+	}
+	type message struct {
+		id          string
+		observation models.Observation
+	}
+	messages := make(chan message, 64)
+	for _, id := range ids {
+		topic, err := observationTopic(d.Config.MqttTopicPrefix, id)
+		if err != nil {
+			return err
+		}
+		remove, err := hub.listen(topic, func(payload []byte) {
+			observation, err := decodeMqttObservation(payload)
+			if err != nil {
+				d.log(ctx).Warn("Skipping undecodable broker message", "topic", topic, "error", err)
+				return
+			}
+			select {
+			case messages <- message{id: id, observation: observation}:
+			default:
+				mqttDropped.Inc()
+			}
+		})
+		if err != nil {
+			return err
+		}
+		defer remove()
+	}
+	watermarks := make(map[string]int64, len(ids))
+	for _, id := range ids {
+		watermarks[id] = 0
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m := <-messages:
+			series := map[string][]models.Observation{m.id: {m.observation}}
+			fresh := advanceWatermarks(series, watermarks)
+			for _, frame := range timeSeriesResponse(thingId, lookup, fresh).Frames {
+				if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
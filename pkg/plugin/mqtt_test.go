@@ -0,0 +1,164 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// In-process stand-in for an MQTT broker.
+type localBroker struct {
+	mu            sync.Mutex
+	subscriptions map[string]func([]byte)
+	subscribed    chan string
+	closed        bool
+}
+
+func newLocalBroker() *localBroker {
+	return &localBroker{
+		subscriptions: make(map[string]func([]byte)),
+		subscribed:    make(chan string, 8),
+	}
+}
+
+func (b *localBroker) Subscribe(topic string, handler func([]byte)) error {
+	b.mu.Lock()
+	b.subscriptions[topic] = handler
+	b.mu.Unlock()
+	b.subscribed <- topic
+	return nil
+}
+
+func (b *localBroker) Unsubscribe(topic string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscriptions, topic)
+	return nil
+}
+
+func (b *localBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+}
+
+func (b *localBroker) publish(topic string, payload string) {
+	b.mu.Lock()
+	handler := b.subscriptions[topic]
+	b.mu.Unlock()
+	if handler != nil {
+		handler([]byte(payload))
+	}
+}
+
+func TestObservationTopic(t *testing.T) {
+	if topic, err := observationTopic("", "42"); err != nil || topic != "v1.1/Datastreams(42)/Observations" {
+		t.Fatal("topic =", topic, err)
+	}
+	for _, id := range []string{"", "+", "#", "1/Observations/#"} {
+		if topic, err := observationTopic("", id); err == nil {
+			t.Fatal("unsafe id accepted:", topic)
+		}
+	}
+}
+
+func TestDecodeMqttObservation(t *testing.T) {
+	standard, err := decodeMqttObservation([]byte(`{"phenomenonTime":"2025-06-01T00:00:00Z/2025-06-01T00:10:00Z","result":4.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if standard.Value != 4.5 || standard.PhenomenonTime != time.Date(2025, 6, 1, 0, 10, 0, 0, time.UTC).UnixMilli() {
+		t.Fatal("standard =", standard)
+	}
+	vendor, err := decodeMqttObservation([]byte(`{"phenomenonTime":1748736000000,"value":2}`))
+	if err != nil || vendor.PhenomenonTime != 1748736000000 {
+		t.Fatal("vendor =", vendor, err)
+	}
+	if _, err := decodeMqttObservation([]byte(`{"phenomenonTime":1}`)); err == nil {
+		t.Fatal("missing result accepted")
+	}
+}
+
+func TestHubSharesSubscriptions(t *testing.T) {
+	broker := newLocalBroker()
+	hub := newMqttHub(broker)
+	var received sync.WaitGroup
+	received.Add(2)
+	removeA, _ := hub.listen("a", func([]byte) { received.Done() })
+	removeB, _ := hub.listen("a", func([]byte) { received.Done() })
+	if len(broker.subscribed) != 1 {
+		t.Fatal("broker subscriptions =", len(broker.subscribed))
+	}
+	broker.publish("a", "{}")
+	received.Wait()
+	removeA()
+	if _, ok := broker.subscriptions["a"]; !ok {
+		t.Fatal("unsubscribed while a listener remains")
+	}
+	removeB()
+	if _, ok := broker.subscriptions["a"]; ok {
+		t.Fatal("still subscribed after last listener left")
+	}
+}
+
+func TestHubResubscribesOnReconnect(t *testing.T) {
+	broker := newLocalBroker()
+	hub := newMqttHub(broker)
+	remove, err := hub.listen("a", func([]byte) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-broker.subscribed
+	// A clean session reconnect leaves the broker without subscriptions
+	broker.Unsubscribe("a")
+	if err := hub.resubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if topic := <-broker.subscribed; topic != "a" {
+		t.Fatal("resubscribed topic =", topic)
+	}
+	remove()
+	if err := hub.resubscribe(); err != nil || len(broker.subscribed) != 0 {
+		t.Fatal("resubscribed a topic without listeners")
+	}
+}
+
+func TestRunStreamFromBroker(t *testing.T) {
+	broker := newLocalBroker()
+	ds := newTestDatasource(t, nil)
+	ds.Config.MqttBrokerUrl = "tcp://broker.test:1883"
+	ds.mqtt = newMqttHub(broker)
+	recorder := &packetRecorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ds.RunStream(ctx, &backend.RunStreamRequest{Path: "datastreams/7"}, backend.NewStreamSender(recorder))
+	}()
+	topic := <-broker.subscribed
+	broker.publish(topic, `{"phenomenonTime":"2025-06-01T00:00:00Z","result":1}`)
+	broker.publish(topic, `{"phenomenonTime":"2025-06-01T00:00:00Z","result":1}`)
+	deadline := time.Now().Add(time.Second)
+	for recorder.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if recorder.count() != 1 {
+		t.Fatal("duplicate observations pushed, packets =", recorder.count())
+	}
+	var frame data.Frame
+	if err := json.Unmarshal(recorder.packets[0].Data, &frame); err != nil {
+		t.Fatal(err)
+	}
+	ds.Dispose()
+	if !broker.closed {
+		t.Fatal("broker connection not closed on dispose")
+	}
+}
@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Datastream name and id as shown in notices.
+func dataStreamLabel(lookup map[string]string, id string) string {
+	if name := lookup[id]; name != "" && name != id {
+		return fmt.Sprintf("%s (%s)", name, id)
+	}
+	return id
+}
+
+// Warnings for datastreams of the query that failed, with the reason for
+// each, and one listing those without observations in the time range. Only
+// the selected datastream is considered when the query names one.
+func dataStreamNotices(qm QueryModel, lookup map[string]string, series map[string][]models.Observation, failed map[string]error) []data.Notice {
+	var ids []string
+	for id := range lookup {
+		if qm.DataStreamId == "" || qm.DataStreamId == id {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	var notices []data.Notice
+	var empty []string
+	for _, id := range ids {
+		if err, ok := failed[id]; ok {
+			text := fmt.Sprintf("Datastream %s failed: %v", dataStreamLabel(lookup, id), err)
+			if len(series[id]) > 0 {
+				text += "; showing cached observations only"
+			}
+			notices = append(notices, data.Notice{Severity: data.NoticeSeverityWarning, Text: text})
+			continue
+		}
+		if len(series[id]) == 0 {
+			empty = append(empty, dataStreamLabel(lookup, id))
+		}
+	}
+	if len(empty) > 0 {
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     "No observations in the time range for " + strings.Join(empty, ", "),
+		})
+	}
+	return notices
+}
+
+// Attach notices to the first frame of a successful response, adding an
+// empty frame to carry them when there is none.
+func attachNotices(response *backend.DataResponse, name string, notices []data.Notice) {
+	if len(notices) == 0 || response.Error != nil {
+		return
+	}
+	if len(response.Frames) == 0 {
+		response.Frames = append(response.Frames, data.NewFrame(name))
+	}
+	frame := response.Frames[0]
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	frame.Meta.Notices = append(frame.Meta.Notices, notices...)
+}
@@ -0,0 +1,115 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+func TestPartialResultsWithNotices(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/datastreams") {
+			w.Write([]byte(`[{"id": "1", "name": "temperature"}, {"id": "2", "name": "salinity"}, {"id": "3", "name": "oxygen"}]`))
+			return
+		}
+		w.Write([]byte(`{"1": [{"value": 1, "phenomenonTime": 0}], "2": "unavailable", "3": []}`))
+	}))
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			JSON:      []byte(`{"thingId": "site"}`),
+			TimeRange: backend.TimeRange{From: time.UnixMilli(0), To: time.UnixMilli(1000)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := resp.Responses["A"]
+	if result.Error != nil || len(result.Frames) != 1 {
+		t.Fatal("expected a frame for the datastream that succeeded, got", result)
+	}
+	notices := result.Frames[0].Meta.Notices
+	if len(notices) != 2 {
+		t.Fatal("expected notices for the failed and the empty datastream, got", notices)
+	}
+	for _, notice := range notices {
+		if notice.Severity != data.NoticeSeverityWarning {
+			t.Fatal("notices should be warnings, got", notice.Severity)
+		}
+	}
+	if !strings.Contains(notices[0].Text, "salinity (2)") || !strings.Contains(notices[1].Text, "oxygen (3)") {
+		t.Fatal("unexpected notices", notices)
+	}
+}
+
+func TestFailedDataStreamIsNotCached(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"1": [], "2": {}}`))
+	}))
+	ds.observationCache = newObservationCache(100)
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, failed, err := ds.cachedObservations(context.Background(), []string{"1", "2"}, day, day.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := failed["2"]; !ok || len(failed) != 1 {
+		t.Fatal("expected only datastream 2 to fail, got", failed)
+	}
+	want := timeInterval{From: day.UnixMilli(), Until: day.Add(time.Hour).UnixMilli()}
+	if len(ds.observationCache.missing("1", want)) != 0 || len(ds.observationCache.missing("2", want)) != 1 {
+		t.Fatal("only the datastream that succeeded should be cached")
+	}
+}
+
+func TestAllDataStreamsFailing(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	_, _, err := ds.cachedObservations(context.Background(), []string{"1", "2"}, time.UnixMilli(0), time.UnixMilli(1000))
+	if status, _ := classifyError(err); status != backend.StatusForbidden {
+		t.Fatal("expected the upstream error when every datastream failed, got", err)
+	}
+}
+
+func TestFailedRefreshKeepsCachedObservations(t *testing.T) {
+	var failing atomic.Bool
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		from, _ := time.Parse(ISO_COMPATIBILITY, r.URL.Query().Get(QUERY_START))
+		json.NewEncoder(w).Encode(map[string][]models.Observation{
+			"1": {{Value: 1, PhenomenonTime: from.UnixMilli()}},
+			"2": {{Value: 2, PhenomenonTime: from.UnixMilli()}},
+		})
+	}))
+	ds.Config.RetryAttempts = 1
+	ds.observationCache = newObservationCache(100)
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, _, err := ds.cachedObservations(context.Background(), []string{"1", "2"}, day, day.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	failing.Store(true)
+	series, failed, err := ds.cachedObservations(context.Background(), []string{"1", "2"}, day, day.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal("cached observations should survive a failed refresh,", err)
+	}
+	if len(series["1"]) != 1 || len(series["2"]) != 1 || len(failed) != 2 {
+		t.Fatal("series =", series, "failed =", failed)
+	}
+	lookup := map[string]string{"1": "temperature", "2": "salinity"}
+	notices := dataStreamNotices(QueryModel{}, lookup, series, failed)
+	if len(notices) != 2 || !strings.Contains(notices[0].Text, "showing cached observations only") {
+		t.Fatal("notices =", notices)
+	}
+}
@@ -0,0 +1,361 @@
+package plugin
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Points held by the observation cache, unless configured.
+const OBSERVATION_CACHE_POINTS = 1_000_000
+// Recent observations may still be arriving upstream, so coverage is only
+// recorded for ranges that ended at least this long ago, unless configured.
+const OBSERVATION_SETTLE = 5 * time.Minute
+// Time after which covered ranges younger than the late arrival window are
+// fetched again, picking up observations that gateways uploaded late.
+const OBSERVATION_RECHECK = 15 * time.Minute
+
+// Inclusive range of epoch milliseconds.
+type timeInterval struct {
+	From  int64
+	Until int64
+}
+
+// Covered range that may still receive late observations, and when it
+// should be fetched again.
+type provisionalInterval struct {
+	timeInterval
+	expires time.Time
+}
+
+// Observations of one datastream, and the time intervals they cover.
+type coveredSeries struct {
+	// Sorted and non-overlapping, past the late arrival window
+	intervals []timeInterval
+	// Recent ranges, covered until they expire
+	provisional []provisionalInterval
+	// Sorted by phenomenon time
+	points   []models.Observation
+	lastUsed time.Time
+}
+
+// Sub-ranges of the interval not covered by the sorted intervals.
+func gaps(covered []timeInterval, want timeInterval) []timeInterval {
+	var result []timeInterval
+	next := want.From
+	for _, c := range covered {
+		if c.Until < next {
+			continue
+		}
+		if c.From > want.Until {
+			break
+		}
+		if c.From > next {
+			result = append(result, timeInterval{From: next, Until: c.From - 1})
+		}
+		next = c.Until + 1
+		if next > want.Until {
+			return result
+		}
+	}
+	if next <= want.Until {
+		result = append(result, timeInterval{From: next, Until: want.Until})
+	}
+	return result
+}
+
+// Add an interval to sorted intervals, merging overlapping and adjacent ones.
+func addInterval(intervals []timeInterval, add timeInterval) []timeInterval {
+	result := make([]timeInterval, 0, len(intervals)+1)
+	inserted := false
+	for _, c := range intervals {
+		switch {
+		case c.Until+1 < add.From:
+			result = append(result, c)
+		case add.Until+1 < c.From:
+			if !inserted {
+				result = append(result, add)
+				inserted = true
+			}
+			result = append(result, c)
+		default:
+			add.From = min(add.From, c.From)
+			add.Until = max(add.Until, c.Until)
+		}
+	}
+	if !inserted {
+		result = append(result, add)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].From < result[j].From
+	})
+	return result
+}
+
+// Observations by datastream for the time ranges already fetched, bounded
+// by the total number of points. The least recently used series are evicted
+// first. A nil cache holds nothing.
+type observationCache struct {
+	mu        sync.Mutex
+	maxPoints int
+	total     int
+	series    map[string]*coveredSeries
+	now       func() time.Time
+	// Age before a range is covered at all
+	settle time.Duration
+	// Age after which no more observations are expected for a range
+	late time.Duration
+}
+
+func newObservationCache(maxPoints int) *observationCache {
+	return &observationCache{
+		maxPoints: maxPoints,
+		series:    make(map[string]*coveredSeries),
+		now:       time.Now,
+		settle:    OBSERVATION_SETTLE,
+		late:      DISK_CACHE_AGE,
+	}
+}
+
+// Observation cache for the configured size and settle window, or nil when
+// disabled. Ranges are final after the age at which the disk cache treats
+// observations as immutable.
+func newObservationCacheFromSettings(config *models.PluginSettings) *observationCache {
+	var cache *observationCache
+	switch {
+	case config.ObservationCachePoints < 0:
+		return nil
+	case config.ObservationCachePoints == 0:
+		cache = newObservationCache(OBSERVATION_CACHE_POINTS)
+	default:
+		cache = newObservationCache(config.ObservationCachePoints)
+	}
+	if config.ObservationSettleMinutes > 0 {
+		cache.settle = time.Duration(config.ObservationSettleMinutes) * time.Minute
+	}
+	if config.DiskCacheAgeHours > 0 {
+		cache.late = time.Duration(config.DiskCacheAgeHours) * time.Hour
+	}
+	return cache
+}
+
+// Intervals of a series currently covered, dropping expired provisional ones.
+func (c *observationCache) coverage(s *coveredSeries) []timeInterval {
+	now := c.now()
+	covered := s.intervals
+	live := s.provisional[:0]
+	for _, p := range s.provisional {
+		if now.Before(p.expires) {
+			live = append(live, p)
+			covered = addInterval(covered, p.timeInterval)
+		}
+	}
+	s.provisional = live
+	return covered
+}
+
+// Parts of the range that must be fetched for a datastream.
+func (c *observationCache) missing(id string, want timeInterval) []timeInterval {
+	if c == nil {
+		return []timeInterval{want}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[id]
+	if !ok {
+		return []timeInterval{want}
+	}
+	return gaps(c.coverage(s), want)
+}
+
+// Cached observations of a datastream within the range.
+func (c *observationCache) points(id string, want timeInterval) []models.Observation {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[id]
+	if !ok {
+		return nil
+	}
+	s.lastUsed = c.now()
+	lo := sort.Search(len(s.points), func(i int) bool { return s.points[i].PhenomenonTime >= want.From })
+	hi := sort.Search(len(s.points), func(i int) bool { return s.points[i].PhenomenonTime > want.Until })
+	return append([]models.Observation(nil), s.points[lo:hi]...)
+}
+
+// Record the observations fetched for a range. Only the settled part of the
+// range is marked as covered, and the part within the late arrival window
+// only until it is due to be checked again.
+func (c *observationCache) store(id string, fetched timeInterval, obs []models.Observation) {
+	if c == nil {
+		return
+	}
+	settled := c.now().Add(-c.settle).UnixMilli()
+	fetched.Until = min(fetched.Until, settled)
+	if fetched.Until < fetched.From {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[id]
+	if !ok {
+		s = &coveredSeries{}
+		c.series[id] = s
+	}
+	s.lastUsed = c.now()
+	merged := make([]models.Observation, 0, len(s.points)+len(obs))
+	for _, o := range s.points {
+		if o.PhenomenonTime < fetched.From || o.PhenomenonTime > fetched.Until {
+			merged = append(merged, o)
+		}
+	}
+	for _, o := range obs {
+		if o.PhenomenonTime >= fetched.From && o.PhenomenonTime <= fetched.Until {
+			merged = append(merged, o)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].PhenomenonTime < merged[j].PhenomenonTime
+	})
+	c.total += len(merged) - len(s.points)
+	s.points = merged
+	final := c.now().Add(-c.late).UnixMilli()
+	if fetched.From <= final {
+		s.intervals = addInterval(s.intervals, timeInterval{From: fetched.From, Until: min(fetched.Until, final)})
+	}
+	if fetched.Until > final {
+		c.coverage(s)
+		s.provisional = append(s.provisional, provisionalInterval{
+			timeInterval: timeInterval{From: max(fetched.From, final+1), Until: fetched.Until},
+			expires:      c.now().Add(OBSERVATION_RECHECK),
+		})
+	}
+	c.evict(id)
+}
+
+// Drop least recently used series, other than the one just stored, until
+// the cache fits within its point limit.
+func (c *observationCache) evict(keep string) {
+	for c.total > c.maxPoints {
+		oldest := ""
+		for id, s := range c.series {
+			if id == keep {
+				continue
+			}
+			if oldest == "" || s.lastUsed.Before(c.series[oldest].lastUsed) {
+				oldest = id
+			}
+		}
+		if oldest == "" {
+			// A single series larger than the limit is not kept
+			c.total -= len(c.series[keep].points)
+			delete(c.series, keep)
+			return
+		}
+		c.total -= len(c.series[oldest].points)
+		delete(c.series, oldest)
+	}
+}
+
+// Drop all cached observations.
+func (c *observationCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.series = make(map[string]*coveredSeries)
+	c.total = 0
+}
+
+// Observations of the datastreams between two times, fetching only the parts
+// of the range missing from the observation cache and the disk store.
+// Datastreams missing the same sub-range are fetched together. Datastreams
+// that could not be fetched or decoded are returned with the reason, and
+// keep whatever was already cached. The query only fails when every
+// datastream failed and none has cached observations in the range.
+func (d *Datasource) cachedObservations(ctx context.Context, ids []string, from time.Time, until time.Time) (map[string][]models.Observation, map[string]error, error) {
+	want := timeInterval{From: from.UnixMilli(), Until: until.UnixMilli()}
+	segments := make(map[timeInterval][]string)
+	var order []timeInterval
+	for _, id := range ids {
+		// A failed read only means refetching from upstream
+		d.promoteObservations(id, want)
+		missing := d.observationCache.missing(id, want)
+		if d.observationCache != nil {
+			observeCache("observations", len(missing) == 0)
+		}
+		for _, gap := range missing {
+			if _, ok := segments[gap]; !ok {
+				order = append(order, gap)
+			}
+			segments[gap] = append(segments[gap], id)
+		}
+	}
+	fetched := make(map[string][]models.Observation)
+	failed := make(map[string]error)
+	var lastErr error
+	for _, gap := range order {
+		series, decodeFailures, err := d.fetchObservations(ctx, segments[gap], time.UnixMilli(gap.From).UTC(), time.UnixMilli(gap.Until).UTC())
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, err
+			}
+			lastErr = err
+			for _, id := range segments[gap] {
+				failed[id] = err
+			}
+			continue
+		}
+		for _, id := range segments[gap] {
+			if err, ok := decodeFailures[id]; ok {
+				failed[id] = err
+				lastErr = err
+				continue
+			}
+			// Persisted ranges are only read back through the observation cache
+			if d.observationCache != nil {
+				d.observationCache.store(id, gap, series[id])
+				if err := d.diskStore.store(id, gap, series[id]); err != nil {
+					d.log(ctx).Warn("Persisting observations failed", "datastream", id, "error", err)
+				}
+			}
+			if len(series[id]) > 0 {
+				fetched[id] = append(fetched[id], series[id]...)
+			}
+		}
+	}
+	allFailed := len(ids) > 0 && len(failed) == len(ids)
+	if d.observationCache == nil {
+		if allFailed {
+			return nil, nil, lastErr
+		}
+		return fetched, failed, nil
+	}
+	result := make(map[string][]models.Observation, len(ids))
+	for _, id := range ids {
+		// Unsettled points are not kept in the cache, so take them from the fetch
+		cached := d.observationCache.points(id, want)
+		seen := make(map[int64]bool, len(cached))
+		for _, o := range cached {
+			seen[o.PhenomenonTime] = true
+		}
+		for _, o := range fetched[id] {
+			if !seen[o.PhenomenonTime] && o.PhenomenonTime >= want.From && o.PhenomenonTime <= want.Until {
+				cached = append(cached, o)
+			}
+		}
+		if len(cached) > 0 {
+			result[id] = cached
+		}
+	}
+	if allFailed && len(result) == 0 {
+		return nil, nil, lastErr
+	}
+	return result, failed, nil
+}
@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+func TestGaps(t *testing.T) {
+	covered := []timeInterval{{From: 10, Until: 19}, {From: 30, Until: 39}}
+	result := gaps(covered, timeInterval{From: 0, Until: 50})
+	expected := []timeInterval{{From: 0, Until: 9}, {From: 20, Until: 29}, {From: 40, Until: 50}}
+	if len(result) != len(expected) {
+		t.Fatal("gaps =", result)
+	}
+	for i := range expected {
+		if result[i] != expected[i] {
+			t.Fatal("gaps =", result)
+		}
+	}
+	if inside := gaps(covered, timeInterval{From: 12, Until: 18}); len(inside) != 0 {
+		t.Fatal("covered range has gaps =", inside)
+	}
+}
+
+func TestAddIntervalMerges(t *testing.T) {
+	intervals := addInterval(nil, timeInterval{From: 30, Until: 39})
+	intervals = addInterval(intervals, timeInterval{From: 0, Until: 9})
+	intervals = addInterval(intervals, timeInterval{From: 10, Until: 29})
+	if len(intervals) != 1 || intervals[0] != (timeInterval{From: 0, Until: 39}) {
+		t.Fatal("intervals =", intervals)
+	}
+}
+
+func TestObservationCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	cache := newObservationCache(3)
+	cache.now = func() time.Time { return now }
+	old := timeInterval{From: 0, Until: 100}
+	cache.store("a", old, []models.Observation{{PhenomenonTime: 1}, {PhenomenonTime: 2}})
+	now = now.Add(time.Second)
+	cache.store("b", old, []models.Observation{{PhenomenonTime: 1}, {PhenomenonTime: 2}})
+	if _, ok := cache.series["a"]; ok {
+		t.Fatal("least recently used series kept")
+	}
+	if cache.total != 2 {
+		t.Fatal("total =", cache.total)
+	}
+}
+
+func TestRecentCoverageExpires(t *testing.T) {
+	cache := newObservationCacheFromSettings(&models.PluginSettings{ObservationSettleMinutes: 30})
+	now := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+	old := timeInterval{From: now.Add(-72 * time.Hour).UnixMilli(), Until: now.Add(-48 * time.Hour).UnixMilli()}
+	recent := timeInterval{From: now.Add(-2 * time.Hour).UnixMilli(), Until: now.UnixMilli()}
+	cache.store("1", old, nil)
+	cache.store("1", recent, nil)
+	settled := now.Add(-30 * time.Minute).UnixMilli()
+	if gaps := cache.missing("1", recent); len(gaps) != 1 || gaps[0].From != settled+1 {
+		t.Fatal("only the unsettled part should be missing, got", gaps)
+	}
+	now = now.Add(OBSERVATION_RECHECK + time.Second)
+	if gaps := cache.missing("1", recent); len(gaps) != 1 || gaps[0].From != recent.From {
+		t.Fatal("recent coverage should expire, missing =", gaps)
+	}
+	if gaps := cache.missing("1", old); len(gaps) != 0 {
+		t.Fatal("old coverage should be kept, missing =", gaps)
+	}
+}
+
+func TestCachedObservationsFetchesOnlyMissingRange(t *testing.T) {
+	var mu sync.Mutex
+	var ranges [][2]string
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, [2]string{r.URL.Query().Get(QUERY_START), r.URL.Query().Get(QUERY_END)})
+		mu.Unlock()
+		from, _ := time.Parse(ISO_COMPATIBILITY, r.URL.Query().Get(QUERY_START))
+		json.NewEncoder(w).Encode(map[string][]models.Observation{
+			"1": {{Value: 1, PhenomenonTime: from.UnixMilli()}},
+		})
+	}))
+	ds.observationCache = newObservationCache(100)
+	day := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, _, err := ds.cachedObservations(context.Background(), []string{"1"}, day, day.Add(24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	series, _, err := ds.cachedObservations(context.Background(), []string{"1"}, day.Add(12*time.Hour), day.Add(36*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 {
+		t.Fatal("requests =", ranges)
+	}
+	if ranges[1][0] != day.Add(24*time.Hour+time.Millisecond).Format(ISO_COMPATIBILITY) {
+		t.Fatal("second request should start after the cached range, got", ranges[1][0])
+	}
+	if len(series["1"]) != 1 {
+		t.Fatal("merged points =", series["1"])
+	}
+}
@@ -0,0 +1,145 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Times a request is repeated after the server asks the client to slow down.
+const RATE_LIMIT_RETRIES = 3
+// Wait assumed when a 429 response has no usable Retry-After header.
+const RETRY_AFTER_DEFAULT = time.Second
+
+// Request refused because the wait for capacity would outlast the caller's
+// deadline, or the server kept asking the client to slow down.
+type rateLimitError struct {
+	Wait time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limited: retry after %s", e.Wait.Round(time.Millisecond))
+}
+
+// Token bucket shared by the upstream requests of a datasource instance. A
+// nil bucket never waits.
+type tokenBucket struct {
+	mu sync.Mutex
+	// Tokens added per second
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// No requests are sent before this time, as asked by the server
+	blocked time.Time
+	now     func() time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// Token bucket for the configured rate, or nil when unlimited.
+func newTokenBucketFromSettings(config *models.PluginSettings) *tokenBucket {
+	if config.RateLimit <= 0 {
+		return nil
+	}
+	return newTokenBucket(config.RateLimit, config.RateLimitBurst)
+}
+
+// Take a token, returning how long the caller must wait before using it.
+// Tokens may go negative, which queues callers in arrival order.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	return max(wait, b.blocked.Sub(now))
+}
+
+// Wait for a token, failing immediately when the wait would outlast the
+// context deadline.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	now := b.now()
+	delay := b.reserve(now)
+	if deadline, ok := ctx.Deadline(); ok && now.Add(delay).After(deadline) {
+		b.tokens++
+		b.mu.Unlock()
+		rateLimited.Inc()
+		return &rateLimitError{Wait: delay}
+	}
+	b.mu.Unlock()
+	if delay > 0 {
+		rateLimitWaits.Observe(delay.Seconds())
+	}
+	return sleep(ctx, delay)
+}
+
+// Hold back every request until the time given by the server.
+func (b *tokenBucket) block(until time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until.After(b.blocked) {
+		b.blocked = until
+	}
+}
+
+// Pause for a duration, returning early when the context is done.
+func sleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Wait requested by a 429 or 503 response, given in seconds or as an HTTP
+// date. Only 429 responses imply a wait when the header is missing.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	header := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(0, date.Sub(now)), true
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return RETRY_AFTER_DEFAULT, true
+	}
+	return 0, false
+}
@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketPacesRequests(t *testing.T) {
+	now := time.Unix(0, 0)
+	bucket := newTokenBucket(2, 2)
+	bucket.last = now
+	waits := []time.Duration{}
+	for i := 0; i < 4; i++ {
+		waits = append(waits, bucket.reserve(now))
+	}
+	expected := []time.Duration{0, 0, 500 * time.Millisecond, time.Second}
+	for i := range expected {
+		if waits[i] != expected[i] {
+			t.Fatalf("wait %d = %s, expected %s", i, waits[i], expected[i])
+		}
+	}
+	bucket.block(now.Add(5 * time.Second))
+	if wait := bucket.reserve(now); wait != 5*time.Second {
+		t.Fatal("server requested wait should hold back requests, got", wait)
+	}
+}
+
+func TestTokenBucketRefusesPastDeadline(t *testing.T) {
+	bucket := newTokenBucket(0.1, 1)
+	if err := bucket.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var limited *rateLimitError
+	if err := bucket.wait(ctx); !errors.As(err, &limited) {
+		t.Fatal("expected rate limited error, got", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		status   int
+		header   string
+		expected time.Duration
+		ok       bool
+	}{
+		{http.StatusTooManyRequests, "3", 3 * time.Second, true},
+		{http.StatusTooManyRequests, "", RETRY_AFTER_DEFAULT, true},
+		{http.StatusServiceUnavailable, now.Add(time.Minute).Format(http.TimeFormat), time.Minute, true},
+		{http.StatusServiceUnavailable, "", 0, false},
+		{http.StatusInternalServerError, "3", 0, false},
+	}
+	for _, c := range cases {
+		resp := &http.Response{StatusCode: c.status, Header: http.Header{}}
+		if c.header != "" {
+			resp.Header.Set("Retry-After", c.header)
+		}
+		wait, ok := retryAfter(resp, now)
+		if wait != c.expected || ok != c.ok {
+			t.Errorf("%d %q: got %s %v", c.status, c.header, wait, ok)
+		}
+	}
+}
+
+func TestFetchHonorsRetryAfter(t *testing.T) {
+	var requests atomic.Int32
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	if _, err := ds.get(context.Background(), "/api/things"); err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 2 {
+		t.Fatal("request should be repeated after the requested wait, got", requests.Load())
+	}
+}
+
+func TestFetchRateLimitedPastDeadline(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := ds.get(ctx, "/api/things")
+	var limited *rateLimitError
+	if !errors.As(err, &limited) {
+		t.Fatal("expected rate limited error, got", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("should fail without waiting for the deadline")
+	}
+}
+
+func TestFetchRateLimitedPastCallerDeadline(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := ds.get(ctx, "/api/things")
+	var limited *rateLimitError
+	if !errors.As(err, &limited) {
+		t.Fatal("expected rate limited error, got", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("should fail without waiting for the deadline")
+	}
+}
@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Attempts per upstream request, including the first, unless configured.
+const RETRY_ATTEMPTS = 3
+// Backoff before the first retry, doubled for each one after it.
+const RETRY_BASE_DELAY = 200 * time.Millisecond
+// Longest backoff between attempts, unless configured.
+const RETRY_MAX_DELAY = 5 * time.Second
+// Display name of the frame statistic counting upstream attempts.
+const STAT_ATTEMPTS = "Upstream attempts"
+
+// Attempts per upstream request, at least one.
+func (d *Datasource) retryAttempts() int {
+	if d.Config.RetryAttempts > 0 {
+		return d.Config.RetryAttempts
+	}
+	return RETRY_ATTEMPTS
+}
+
+// Jittered exponential backoff before the given retry, counting from one.
+// The full jitter spreads out clients that failed together.
+func (d *Datasource) backoff(retry int) time.Duration {
+	limit := RETRY_MAX_DELAY
+	if d.Config.RetryMaxDelayMs > 0 {
+		limit = time.Duration(d.Config.RetryMaxDelayMs) * time.Millisecond
+	}
+	delay := limit
+	if retry < 32 {
+		delay = min(limit, RETRY_BASE_DELAY<<(retry-1))
+	}
+	return rand.N(delay) + 1
+}
+
+// Whether a failed GET may succeed when repeated: transport failures and
+// server errors, but not cancellation, client errors or signing failures.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var upstream *upstreamError
+	if errors.As(err, &upstream) {
+		return upstream.StatusCode >= 500
+	}
+	return backend.IsDownstreamError(err)
+}
+
+// Upstream attempts made, and response bytes received, on behalf of a query.
+type upstreamStats struct {
+	attempts atomic.Int64
+	bytes    atomic.Int64
+}
+
+type upstreamStatsKey struct{}
+
+// Context that counts the upstream work done on behalf of a query.
+func withUpstreamStats(ctx context.Context) (context.Context, *upstreamStats) {
+	stats := &upstreamStats{}
+	return context.WithValue(ctx, upstreamStatsKey{}, stats), stats
+}
+
+// Add to the upstream counters of the context, if it has them.
+func countUpstream(ctx context.Context, attempts int, bytes int) {
+	if stats, ok := ctx.Value(upstreamStatsKey{}).(*upstreamStats); ok {
+		stats.attempts.Add(int64(attempts))
+		stats.bytes.Add(int64(bytes))
+	}
+}
+
+// Record the number of upstream attempts in the metadata of each frame.
+func recordAttempts(response *backend.DataResponse, attempts int64) {
+	for _, frame := range response.Frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		frame.Meta.Stats = append(frame.Meta.Stats, data.QueryStat{
+			FieldConfig: data.FieldConfig{DisplayName: STAT_ATTEMPTS},
+			Value:       float64(attempts),
+		})
+	}
+}
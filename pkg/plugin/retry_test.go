@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+func TestBackoffIsBounded(t *testing.T) {
+	ds := &Datasource{Config: &models.PluginSettings{RetryMaxDelayMs: 300}}
+	for retry := 1; retry < 40; retry++ {
+		delay := ds.backoff(retry)
+		if delay <= 0 || delay > 300*time.Millisecond {
+			t.Fatalf("retry %d backoff %s outside (0, 300ms]", retry, delay)
+		}
+	}
+	if delay := ds.backoff(1); delay > RETRY_BASE_DELAY {
+		t.Fatal("first backoff should not exceed the base delay, got", delay)
+	}
+}
+
+func TestFetchRetriesTransientFailures(t *testing.T) {
+	var requests atomic.Int32
+	var dates []string
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			t.Error("every attempt should be signed")
+		}
+		dates = append(dates, r.Header.Get("Date"))
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	ds.Config.RetryMaxDelayMs = 10
+	ctx, stats := withUpstreamStats(context.Background())
+	if _, err := ds.get(ctx, "/api/things"); err != nil {
+		t.Fatal(err)
+	}
+	if stats.attempts.Load() != 3 || len(dates) != 3 {
+		t.Fatal("expected 3 attempts, got", stats.attempts.Load())
+	}
+	for i := 1; i < len(dates); i++ {
+		if dates[i] < dates[i-1] {
+			t.Fatal("each attempt should be signed at its own time", dates)
+		}
+	}
+}
+
+func TestFetchDoesNotRetryClientErrors(t *testing.T) {
+	var requests atomic.Int32
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	if _, err := ds.get(context.Background(), "/api/things"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if requests.Load() != 1 {
+		t.Fatal("client errors should not be retried, got", requests.Load())
+	}
+}
+
+func TestQueryRecordsAttempts(t *testing.T) {
+	var failed atomic.Bool
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/datastreams") {
+			json.NewEncoder(w).Encode([]models.DataStream{{Id: "1", Name: "temperature"}})
+			return
+		}
+		if !failed.Swap(true) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]models.Observation{"1": {{Value: 1, PhenomenonTime: 0}}})
+	}))
+	ds.Config.RetryMaxDelayMs = 10
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			JSON:      []byte(`{"thingId": "site"}`),
+			TimeRange: backend.TimeRange{From: time.UnixMilli(0), To: time.UnixMilli(1000)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := resp.Responses["A"].Frames
+	if resp.Responses["A"].Error != nil || len(frames) != 1 {
+		t.Fatal("unexpected response", resp.Responses["A"])
+	}
+	stats := frames[0].Meta.Stats
+	if len(stats) != 1 || stats[0].DisplayName != STAT_ATTEMPTS || stats[0].Value != 3 {
+		t.Fatal("expected 3 upstream attempts in frame metadata, got", stats)
+	}
+}
@@ -0,0 +1,256 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Live channel path prefix for all datastreams of a thing.
+const STREAM_THING = "thing"
+// Live channel path prefix for a set of datastreams, one per segment.
+const STREAM_DATASTREAMS = "datastreams"
+// Prefix of the last channel path segment giving the end of the query, in
+// epoch milliseconds, after which observations are pushed.
+const STREAM_SINCE = "since="
+// Polling interval used when the settings do not specify one.
+const STREAM_INTERVAL = 10 * time.Second
+// How far before the previous poll observations may still arrive late.
+const STREAM_SLACK = time.Minute
+
+// Characters allowed in a Grafana Live channel path segment.
+var livePathPattern = regexp.MustCompile(`^[A-Za-z0-9_=\-.]+$`)
+
+// Parsed live channel path.
+type streamPath struct {
+	thingId       string
+	dataStreamIds []string
+	// End of the query the channel belongs to, zero when not given
+	since time.Time
+}
+
+// Parse a live channel path into a thing id, optionally followed by one of
+// its datastreams, or a set of datastream ids. Either may end with the time
+// from which to push observations.
+func parseStreamPath(path string) (streamPath, error) {
+	segments := strings.Split(path, "/")
+	var parsed streamPath
+	if last := segments[len(segments)-1]; strings.HasPrefix(last, STREAM_SINCE) {
+		millis, err := strconv.ParseInt(strings.TrimPrefix(last, STREAM_SINCE), 10, 64)
+		if err != nil {
+			return streamPath{}, fmt.Errorf("invalid stream path %q", path)
+		}
+		parsed.since = time.UnixMilli(millis).UTC()
+		segments = segments[:len(segments)-1]
+	}
+	if len(segments) < 2 || slices.Contains(segments[1:], "") {
+		return streamPath{}, fmt.Errorf("invalid stream path %q", path)
+	}
+	switch segments[0] {
+	case STREAM_THING:
+		if len(segments) > 3 {
+			return streamPath{}, fmt.Errorf("invalid stream path %q", path)
+		}
+		parsed.thingId = segments[1]
+		parsed.dataStreamIds = segments[2:]
+		if len(parsed.dataStreamIds) == 0 {
+			parsed.dataStreamIds = nil
+		}
+		return parsed, nil
+	case STREAM_DATASTREAMS:
+		parsed.dataStreamIds = segments[1:]
+		return parsed, nil
+	}
+	return streamPath{}, fmt.Errorf("unknown stream kind %q", segments[0])
+}
+
+// Time between polls for new observations.
+func (d *Datasource) streamInterval() time.Duration {
+	if d.Config.StreamInterval > 0 {
+		return time.Duration(d.Config.StreamInterval) * time.Second
+	}
+	return STREAM_INTERVAL
+}
+
+// Keep observations newer than the watermark of their datastream, and
+// advance each watermark to the latest phenomenon time seen.
+func advanceWatermarks(series map[string][]models.Observation, watermarks map[string]int64) map[string][]models.Observation {
+	fresh := make(map[string][]models.Observation)
+	for id, obs := range series {
+		mark, ok := watermarks[id]
+		if !ok {
+			continue
+		}
+		for _, observation := range obs {
+			if observation.PhenomenonTime <= mark {
+				continue
+			}
+			fresh[id] = append(fresh[id], observation)
+			if observation.PhenomenonTime > watermarks[id] {
+				watermarks[id] = observation.PhenomenonTime
+			}
+		}
+	}
+	return fresh
+}
+
+// SubscribeStream is called when a client wants to connect to a stream. Only
+// thing and datastream channel paths are accepted.
+func (d *Datasource) SubscribeStream(_ context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	if _, err := parseStreamPath(req.Path); err != nil {
+		return &backend.SubscribeStreamResponse{
+			Status: backend.SubscribeStreamStatusNotFound,
+		}, nil
+	}
+	return &backend.SubscribeStreamResponse{
+		Status: backend.SubscribeStreamStatusOK,
+	}, nil
+}
+
+// RunStream is called once for each channel with subscribers. It polls the
+// observations endpoint and pushes only points newer than those already sent,
+// until Grafana cancels the context when the last subscriber leaves. When an
+// MQTT broker is configured, observations are pushed as they are published.
+func (d *Datasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	if d.settingsErr != nil {
+		return d.invalidSettings()
+	}
+	path, err := parseStreamPath(req.Path)
+	if err != nil {
+		return err
+	}
+	thingId, ids := path.thingId, path.dataStreamIds
+	lookup := make(map[string]string)
+	if thingId != "" {
+		dataStreams, err := d.dataStreams(ctx, thingId)
+		if err != nil {
+			return err
+		}
+		all := len(ids) == 0
+		for _, ds := range dataStreams {
+			if all {
+				ids = append(ids, ds.Id)
+			}
+			lookup[ds.Id] = ds.Name
+		}
+	}
+	if d.usesMqtt() {
+		return d.runMqttStream(ctx, thingId, ids, lookup, sender)
+	}
+	// Observations up to the end of the query were already returned
+	start := path.since
+	if start.IsZero() {
+		start = time.Now().UTC()
+	}
+	watermarks := make(map[string]int64, len(ids))
+	for _, id := range ids {
+		watermarks[id] = start.UnixMilli()
+	}
+	ticker := time.NewTicker(d.streamInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			now := time.Now().UTC()
+			series, _, err := d.fetchObservations(ctx, ids, pollStart(watermarks, now, d.streamInterval()), now)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				d.log(ctx).Warn("Polling live channel failed", "path", req.Path, "error", err)
+				err = sendStreamError(sender, thingId, ids, lookup, err)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			fresh := advanceWatermarks(series, watermarks)
+			for _, frame := range timeSeriesResponse(thingId, lookup, fresh).Frames {
+				if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// Start of the window to poll: the oldest watermark, but no earlier than
+// the previous poll less the slack, so a datastream that never reports does
+// not keep widening the window.
+func pollStart(watermarks map[string]int64, now time.Time, interval time.Duration) time.Time {
+	from := now
+	for _, mark := range watermarks {
+		if t := time.UnixMilli(mark); t.Before(from) {
+			from = t
+		}
+	}
+	if earliest := now.Add(-interval - STREAM_SLACK); from.Before(earliest) {
+		return earliest
+	}
+	return from
+}
+
+// Report a failed poll on the channel with an empty frame per datastream,
+// keeping the schema of the frames already sent, so panels show the error
+// without losing their data.
+func sendStreamError(sender *backend.StreamSender, thingId string, ids []string, lookup map[string]string, cause error) error {
+	for _, id := range ids {
+		frame := observationFrame(thingId, id, lookup, nil)
+		frame.Meta.Notices = []data.Notice{{
+			Severity: data.NoticeSeverityError,
+			Text:     "Polling for new observations failed: " + cause.Error(),
+		}}
+		if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Channel streaming observations of a datastream after the end of a query,
+// or empty when the ids cannot be used in a channel path.
+func liveChannel(uid string, thingId string, dataStreamId string, since time.Time) string {
+	for _, part := range []string{uid, thingId, dataStreamId} {
+		if !livePathPattern.MatchString(part) {
+			return ""
+		}
+	}
+	segments := []string{"ds", uid, STREAM_THING, thingId, dataStreamId}
+	if !since.IsZero() {
+		segments = append(segments, STREAM_SINCE+strconv.FormatInt(since.UnixMilli(), 10))
+	}
+	return strings.Join(segments, "/")
+}
+
+// Point each time series frame at the live channel of its datastream, so
+// Grafana subscribes and appends new observations as they arrive.
+func setLiveChannels(response *backend.DataResponse, pCtx backend.PluginContext, thingId string, since time.Time) {
+	if pCtx.DataSourceInstanceSettings == nil {
+		return
+	}
+	for _, frame := range response.Frames {
+		if len(frame.Fields) < 2 || frame.Meta == nil {
+			continue
+		}
+		frame.Meta.Channel = liveChannel(pCtx.DataSourceInstanceSettings.UID, thingId, frame.Fields[1].Labels["datastream"], since)
+	}
+}
+
+// PublishStream is called when a client sends a message to the stream.
+// Channels are read only.
+func (d *Datasource) PublishStream(_ context.Context, _ *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{
+		Status: backend.PublishStreamStatusPermissionDenied,
+	}, nil
+}
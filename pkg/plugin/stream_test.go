@@ -0,0 +1,214 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Collects frames pushed to a live channel.
+type packetRecorder struct {
+	mu      sync.Mutex
+	packets []*backend.StreamPacket
+}
+
+func (r *packetRecorder) Send(packet *backend.StreamPacket) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets = append(r.packets, packet)
+	return nil
+}
+
+func (r *packetRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.packets)
+}
+
+func TestParseStreamPath(t *testing.T) {
+	path, err := parseStreamPath("thing/site-1")
+	if err != nil || path.thingId != "site-1" || path.dataStreamIds != nil || !path.since.IsZero() {
+		t.Fatal("thing path =", path, err)
+	}
+	path, err = parseStreamPath("datastreams/1/2")
+	if err != nil || len(path.dataStreamIds) != 2 {
+		t.Fatal("datastreams path =", path, err)
+	}
+	path, err = parseStreamPath("thing/site/1/since=1000")
+	if err != nil || path.thingId != "site" || len(path.dataStreamIds) != 1 || path.since.UnixMilli() != 1000 {
+		t.Fatal("thing path with start =", path, err)
+	}
+	for _, invalid := range []string{"sites", "datastreams/", "thing/site/1/2", "thing/site/since=soon"} {
+		if _, err = parseStreamPath(invalid); err == nil {
+			t.Fatal("invalid path accepted:", invalid)
+		}
+	}
+}
+
+func TestStreamPathsAreLiveChannels(t *testing.T) {
+	since := time.UnixMilli(1748736000000)
+	for _, channel := range []string{liveChannel("hmac", "site-1", "7", since), "ds/hmac/datastreams/1/2"} {
+		parsed, err := live.ParseChannel(channel)
+		if err != nil {
+			t.Fatal(channel, err)
+		}
+		if _, err := parseStreamPath(parsed.Path); err != nil {
+			t.Fatal(channel, err)
+		}
+	}
+	if _, err := live.ParseChannel("ds/hmac/datastreams/1,2"); err == nil {
+		t.Fatal("comma separated ids are not valid channel paths")
+	}
+}
+
+func TestAdvanceWatermarks(t *testing.T) {
+	watermarks := map[string]int64{"1": 100}
+	series := map[string][]models.Observation{
+		"1": {{Value: 1, PhenomenonTime: 100}, {Value: 2, PhenomenonTime: 200}},
+		"2": {{Value: 3, PhenomenonTime: 300}},
+	}
+	fresh := advanceWatermarks(series, watermarks)
+	if len(fresh["1"]) != 1 || len(fresh["2"]) != 0 {
+		t.Fatal("fresh =", fresh)
+	}
+	if watermarks["1"] != 200 {
+		t.Fatal("watermark =", watermarks["1"])
+	}
+	if again := advanceWatermarks(series, watermarks); len(again) != 0 {
+		t.Fatal("points sent twice =", again)
+	}
+}
+
+func TestRunStreamPushesNewPoints(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().UnixMilli()
+		json.NewEncoder(w).Encode(map[string][]models.Observation{
+			"7": {{Value: 1, PhenomenonTime: now - int64(time.Hour/time.Millisecond)}, {Value: 2, PhenomenonTime: now}},
+		})
+	}))
+	ds.Config.StreamInterval = 1
+	recorder := &packetRecorder{}
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	err := ds.RunStream(ctx, &backend.RunStreamRequest{Path: "datastreams/7"}, backend.NewStreamSender(recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder.count() != 1 {
+		t.Fatal("packet count =", recorder.count())
+	}
+	var frame data.Frame
+	if err := json.Unmarshal(recorder.packets[0].Data, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Rows() != 1 {
+		t.Fatal("only the new point should be sent, rows =", frame.Rows())
+	}
+}
+
+func TestRunStreamStartsAtQueryEnd(t *testing.T) {
+	queryEnd := time.Now().Add(-30 * time.Second)
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]models.Observation{
+			"7": {{Value: 1, PhenomenonTime: queryEnd.UnixMilli()}, {Value: 2, PhenomenonTime: queryEnd.Add(10 * time.Second).UnixMilli()}},
+		})
+	}))
+	ds.Config.StreamInterval = 1
+	recorder := &packetRecorder{}
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	path := fmt.Sprintf("datastreams/7/since=%d", queryEnd.UnixMilli())
+	if err := ds.RunStream(ctx, &backend.RunStreamRequest{Path: path}, backend.NewStreamSender(recorder)); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.count() != 1 {
+		t.Fatal("points after the query end should be pushed, packets =", recorder.count())
+	}
+	var frame data.Frame
+	if err := json.Unmarshal(recorder.packets[0].Data, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Rows() != 1 {
+		t.Fatal("only the point after the query end should be sent, rows =", frame.Rows())
+	}
+}
+
+func TestPollStartIsCapped(t *testing.T) {
+	now := time.Now()
+	silent := now.Add(-time.Hour).UnixMilli()
+	recent := now.Add(-5 * time.Second).UnixMilli()
+	from := pollStart(map[string]int64{"silent": silent, "recent": recent}, now, 10*time.Second)
+	if !from.Equal(now.Add(-10*time.Second - STREAM_SLACK)) {
+		t.Fatal("a silent datastream should not widen the window, from =", now.Sub(from))
+	}
+	from = pollStart(map[string]int64{"recent": recent}, now, 10*time.Second)
+	if from.UnixMilli() != recent {
+		t.Fatal("from =", from)
+	}
+}
+
+func TestRunStreamReportsErrors(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	ds.Config.StreamInterval = 1
+	recorder := &packetRecorder{}
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	err := ds.RunStream(ctx, &backend.RunStreamRequest{Path: "datastreams/7"}, backend.NewStreamSender(recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder.count() != 1 {
+		t.Fatal("packet count =", recorder.count())
+	}
+	var frame data.Frame
+	if err := json.Unmarshal(recorder.packets[0].Data, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Rows() != 0 || len(frame.Meta.Notices) != 1 {
+		t.Fatal("expected an empty frame with a notice, got", frame.Rows(), frame.Meta)
+	}
+}
+
+func TestQueryDataSetsLiveChannels(t *testing.T) {
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/datastreams") {
+			json.NewEncoder(w).Encode([]models.DataStream{{Id: "1", Name: "Temperature"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]models.Observation{"1": {{Value: 1, PhenomenonTime: 1000}}})
+	}))
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "hmac"},
+		},
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			JSON:      []byte(`{"thingId": "site", "live": true}`),
+			TimeRange: backend.TimeRange{From: time.UnixMilli(0), To: time.UnixMilli(2000)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := resp.Responses["A"].Frames
+	if len(frames) != 1 || frames[0].Meta.Channel != "ds/hmac/thing/site/1/since=2000" {
+		t.Fatal("frames =", frames)
+	}
+	path, err := parseStreamPath("thing/site/1/since=2000")
+	if err != nil || path.thingId != "site" || len(path.dataStreamIds) != 1 || path.dataStreamIds[0] != "1" {
+		t.Fatal("channel path =", path, err)
+	}
+}
@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Query type for threshold exceedance intervals.
+const QUERY_TYPE_THRESHOLD = "threshold"
+
+// Directions accepted by threshold queries.
+const (
+	DIRECTION_ABOVE = "above"
+	DIRECTION_BELOW = "below"
+)
+
+// Contiguous period during which a series stayed past the threshold.
+type exceedance struct {
+	Start time.Time
+	End   time.Time
+	Peak  float64
+}
+
+// Copy of observations ordered by phenomenon time, without NaN values.
+func sortedObservations(obs []models.Observation) []models.Observation {
+	sorted := make([]models.Observation, 0, len(obs))
+	for _, observation := range obs {
+		if !math.IsNaN(observation.Value) {
+			sorted = append(sorted, observation)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].PhenomenonTime < sorted[j].PhenomenonTime
+	})
+	return sorted
+}
+
+// Time at which the line between two observations crosses the threshold.
+func crossing(a models.Observation, b models.Observation, threshold float64) time.Time {
+	if a.Value == b.Value {
+		return time.UnixMilli(b.PhenomenonTime)
+	}
+	fraction := (threshold - a.Value) / (b.Value - a.Value)
+	ms := float64(a.PhenomenonTime) + fraction*float64(b.PhenomenonTime-a.PhenomenonTime)
+	return time.UnixMilli(int64(math.Round(ms)))
+}
+
+// Find the intervals where observations are past the threshold. Interval
+// edges are interpolated between samples, and clamped to the first and last
+// observation at the edges of the series.
+func exceedances(obs []models.Observation, threshold float64, direction string) []exceedance {
+	past := func(v float64) bool {
+		if direction == DIRECTION_BELOW {
+			return v < threshold
+		}
+		return v > threshold
+	}
+	sorted := sortedObservations(obs)
+	var result []exceedance
+	var current *exceedance
+	for i, observation := range sorted {
+		if past(observation.Value) {
+			if current == nil {
+				start := time.UnixMilli(observation.PhenomenonTime)
+				if i > 0 {
+					start = crossing(sorted[i-1], observation, threshold)
+				}
+				current = &exceedance{Start: start, Peak: observation.Value}
+			}
+			if direction == DIRECTION_BELOW {
+				current.Peak = math.Min(current.Peak, observation.Value)
+			} else {
+				current.Peak = math.Max(current.Peak, observation.Value)
+			}
+			current.End = time.UnixMilli(observation.PhenomenonTime)
+			continue
+		}
+		if current != nil {
+			current.End = crossing(sorted[i-1], observation, threshold)
+			result = append(result, *current)
+			current = nil
+		}
+	}
+	if current != nil {
+		result = append(result, *current)
+	}
+	return result
+}
+
+// Build a table of exceedance intervals, and a second frame with the total
+// time in exceedance for each datastream over the query range.
+func thresholdResponse(qm QueryModel, lookup map[string]string, series map[string][]models.Observation) backend.DataResponse {
+	var response backend.DataResponse
+	if qm.Threshold == nil {
+		return backend.ErrDataResponseWithSource(backend.StatusBadRequest, backend.ErrorSourceDownstream, "threshold is required")
+	}
+	direction := qm.Direction
+	if direction == "" {
+		direction = DIRECTION_ABOVE
+	}
+	if direction != DIRECTION_ABOVE && direction != DIRECTION_BELOW {
+		return backend.ErrDataResponseWithSource(backend.StatusBadRequest, backend.ErrorSourceDownstream, fmt.Sprintf("unknown direction %q", direction))
+	}
+	ids := make([]string, 0, len(series))
+	for k := range series {
+		if qm.DataStreamId == "" || qm.DataStreamId == k {
+			ids = append(ids, k)
+		}
+	}
+	sort.Strings(ids)
+
+	var names, totalNames []string
+	var starts, ends []time.Time
+	var durations, peaks, totals []float64
+	for _, id := range ids {
+		total := 0.0
+		for _, interval := range exceedances(series[id], *qm.Threshold, direction) {
+			seconds := interval.End.Sub(interval.Start).Seconds()
+			names = append(names, lookup[id])
+			starts = append(starts, interval.Start)
+			ends = append(ends, interval.End)
+			durations = append(durations, seconds)
+			peaks = append(peaks, interval.Peak)
+			total += seconds
+		}
+		totalNames = append(totalNames, lookup[id])
+		totals = append(totals, total)
+	}
+	seconds := &data.FieldConfig{Unit: "s"}
+	intervals := data.NewFrame("exceedances",
+		data.NewField("datastream", nil, names),
+		data.NewField("start", nil, starts),
+		data.NewField("end", nil, ends),
+		data.NewField("duration", nil, durations).SetConfig(seconds),
+		data.NewField("peak", nil, peaks),
+	)
+	intervals.SetMeta(&data.FrameMeta{PreferredVisualization: data.VisTypeTable})
+	summary := data.NewFrame("total",
+		data.NewField("datastream", nil, totalNames),
+		data.NewField("duration", nil, totals).SetConfig(seconds),
+	)
+	summary.SetMeta(&data.FrameMeta{PreferredVisualization: data.VisTypeTable})
+	response.Frames = append(response.Frames, intervals, summary)
+	return response
+}
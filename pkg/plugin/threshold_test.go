@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+// Minutes since a fixed origin as an observation timestamp
+func minute(m int) int64 {
+	return time.Date(2025, 7, 1, 0, m, 0, 0, time.UTC).UnixMilli()
+}
+
+func TestExceedancesBelow(t *testing.T) {
+	obs := []models.Observation{
+		{Value: 4, PhenomenonTime: minute(0)},
+		{Value: 0, PhenomenonTime: minute(10)},
+		{Value: 1, PhenomenonTime: minute(20)},
+		{Value: 3, PhenomenonTime: minute(30)},
+		{Value: 5, PhenomenonTime: minute(40)},
+	}
+	intervals := exceedances(obs, 2, DIRECTION_BELOW)
+	if len(intervals) != 1 {
+		t.Fatal("interval count =", len(intervals))
+	}
+	interval := intervals[0]
+	// Crosses 2 halfway between minute 0 and 10, and again between 20 and 30
+	if !interval.Start.Equal(time.UnixMilli(minute(5))) {
+		t.Fatal("start =", interval.Start)
+	}
+	if !interval.End.Equal(time.UnixMilli(minute(25))) {
+		t.Fatal("end =", interval.End)
+	}
+	if interval.Peak != 0 {
+		t.Fatal("peak =", interval.Peak)
+	}
+}
+
+func TestExceedancesOpenEnded(t *testing.T) {
+	obs := []models.Observation{
+		{Value: 12, PhenomenonTime: minute(10)},
+		{Value: 8, PhenomenonTime: minute(0)},
+		{Value: 15, PhenomenonTime: minute(20)},
+	}
+	intervals := exceedances(obs, 10, DIRECTION_ABOVE)
+	if len(intervals) != 1 || intervals[0].Peak != 15 {
+		t.Fatal("intervals =", intervals)
+	}
+	if !intervals[0].End.Equal(time.UnixMilli(minute(20))) {
+		t.Fatal("end =", intervals[0].End)
+	}
+}
+
+func TestThresholdResponse(t *testing.T) {
+	threshold := 2.0
+	series := map[string][]models.Observation{
+		"1": {{Value: 1, PhenomenonTime: minute(0)}, {Value: 1, PhenomenonTime: minute(30)}},
+		"2": {{Value: 5, PhenomenonTime: minute(0)}},
+	}
+	qm := QueryModel{Threshold: &threshold, Direction: DIRECTION_BELOW}
+	resp := thresholdResponse(qm, map[string]string{"1": "DO", "2": "Temperature"}, series)
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	total := resp.Frames[1]
+	if total.Rows() != 2 {
+		t.Fatal("total rows =", total.Rows())
+	}
+	if seconds := total.Fields[1].At(0).(float64); seconds != 1800 {
+		t.Fatal("total duration =", seconds)
+	}
+	missing := thresholdResponse(QueryModel{}, nil, series)
+	if missing.Error == nil {
+		t.Fatal("missing threshold accepted")
+	}
+}
@@ -0,0 +1,33 @@
+package plugin
+
+import (
+	"context"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Span attribute for the thing being queried.
+const ATTR_THING_ID = "hmac.thing_id"
+// Span attribute for the number of datastreams involved.
+const ATTR_DATASTREAMS = "hmac.datastream_count"
+// Span attribute for the number of observations decoded or framed.
+const ATTR_POINTS = "hmac.point_count"
+// Span attribute for the kind of API endpoint requested.
+const ATTR_ENDPOINT = "hmac.endpoint"
+// Span attribute for the attempt number of an upstream request.
+const ATTR_ATTEMPT = "hmac.attempt"
+
+// Start a span with the tracer configured by the SDK. Only identifiers and
+// counts are recorded as attributes, never secrets, signatures or headers.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.DefaultTracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Mark a span as failed when there is an error.
+func spanError(span trace.Span, err error) {
+	if err != nil {
+		tracing.Error(span, err)
+	}
+}
@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/hurricane-island/grafana-hmac-datasource/pkg/models"
+)
+
+func TestQuerySpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracing.InitDefaultTracer(provider.Tracer("test"))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		tracing.InitDefaultTracer(otel.Tracer("test"))
+	})
+	var propagated []string
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		propagated = append(propagated, r.Header.Get("Traceparent"))
+		if strings.HasSuffix(r.URL.Path, "/datastreams") {
+			json.NewEncoder(w).Encode([]models.DataStream{{Id: "1"}, {Id: "2"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]models.Observation{"1": {{Value: 1, PhenomenonTime: 0}}})
+	}))
+	_, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			JSON:      []byte(`{"thingId": "site"}`),
+			TimeRange: backend.TimeRange{From: time.UnixMilli(0), To: time.UnixMilli(1000)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range propagated {
+		if header == "" {
+			t.Fatal("upstream requests should carry the trace context")
+		}
+	}
+	names := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		names[span.Name()] = span
+		for _, attr := range span.Attributes() {
+			if strings.Contains(attr.Value.Emit(), "c2VjcmV0") {
+				t.Fatal("span recorded a secret:", span.Name(), attr.Key)
+			}
+		}
+	}
+	for _, name := range []string{"QueryData", "query", "sign request", "upstream request", "decode datastreams", "decode observations", "build frames"} {
+		if _, ok := names[name]; !ok {
+			t.Fatal("missing span", name)
+		}
+	}
+	attrs := make(map[string]int64)
+	for _, attr := range names["query"].Attributes() {
+		attrs[string(attr.Key)] = attr.Value.AsInt64()
+	}
+	if attrs[ATTR_DATASTREAMS] != 2 || attrs[ATTR_POINTS] != 1 {
+		t.Fatal("query span should count datastreams and points, got", attrs)
+	}
+	if names["query"].Parent().SpanID() != names["QueryData"].SpanContext().SpanID() {
+		t.Fatal("query span should be a child of QueryData")
+	}
+}
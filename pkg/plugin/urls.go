@@ -0,0 +1,46 @@
+package plugin
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Escaped API path below the configured base path. Each segment is escaped
+// on its own, so identifiers containing slashes, spaces or reserved
+// characters stay within their segment.
+func (d *Datasource) apiPath(segments ...string) string {
+	escaped := make([]string, len(segments)+1)
+	escaped[0] = (&url.URL{Path: d.Config.BasePath}).EscapedPath()
+	for i, segment := range segments {
+		escaped[i+1] = url.PathEscape(segment)
+	}
+	return strings.Join(escaped, "/")
+}
+
+// Path of the observations of datastreams between two times, with the
+// parameters in the order the API documents. Each id is escaped on its own
+// and joined with a literal comma, and the timestamps need no escaping.
+func (d *Datasource) observationsPath(ids []string, from time.Time, until time.Time) string {
+	escaped := make([]string, len(ids))
+	for i, id := range ids {
+		escaped[i] = url.QueryEscape(id)
+	}
+	return d.apiPath(strings.TrimPrefix(QUERY_PATH, "/")) +
+		"?" + QUERY_START + "=" + from.Format(ISO_COMPATIBILITY) +
+		"&" + QUERY_END + "=" + until.Format(ISO_COMPATIBILITY) +
+		"&" + QUERY_TAGS + "=" + strings.Join(escaped, ",")
+}
+
+// Segments of a resource path from the frontend, refusing empty segments and
+// ones that would leave the base path.
+func resourceSegments(path string) ([]string, error) {
+	segments := strings.Split(path, "/")
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, fmt.Errorf("invalid resource path %q", path)
+		}
+	}
+	return segments, nil
+}
@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestApiPathEscapesSegments(t *testing.T) {
+	ds := newTestDatasource(t, http.NotFoundHandler())
+	got := ds.apiPath(QUERY_ROOT, "a b/c+d?x=1", QUERY_COLLECTION)
+	if got != "/api/site/a%20b%2Fc+d%3Fx=1/datastreams" {
+		t.Fatal("path =", got)
+	}
+	ds.Config.BasePath = ""
+	if got := ds.apiPath(INDEX_NAME); got != "/sites" {
+		t.Fatal("path at the server root =", got)
+	}
+}
+
+func TestObservationsPathCannotInjectParameters(t *testing.T) {
+	ds := newTestDatasource(t, http.NotFoundHandler())
+	from := time.Date(2025, 5, 20, 0, 0, 0, 0, time.UTC)
+	got := ds.observationsPath([]string{"1&until=now", "2"}, from, from.Add(time.Hour))
+	want := "/api/observations?from=2025-05-20T00:00:00.000Z&until=2025-05-20T01:00:00.000Z&datastreamIds=1%26until%3Dnow,2"
+	if got != want {
+		t.Fatal("path =", got)
+	}
+}
+
+// Server checking the signature against the path and query it received.
+func TestSignatureCoversEscapedPath(t *testing.T) {
+	var received string
+	ds := newTestDatasource(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.URL.RawPath
+		date, _ := time.Parse(ISO_COMPATIBILITY, r.Header.Get("Date"))
+		data := hmacStringArray(date, "client", r.URL.RequestURI())
+		want := authHeader(AUTH_METHOD, "client", signedHmacBytes(strings.Join(data, "\n"), "c2VjcmV0"))
+		if r.Header.Get("Authorization") != want {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`[{"id": "ds", "name": "temperature"}]`))
+	}))
+	dataStreams, err := ds.fetchDataStreams(context.Background(), "north/pier 1+2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != "/api/site/north%2Fpier%201+2/datastreams" || len(dataStreams) != 1 {
+		t.Fatal("received", received, dataStreams)
+	}
+}
+
+func TestCallResourceRejectsTraversal(t *testing.T) {
+	ds := newTestDatasource(t, http.NotFoundHandler())
+	recorder := &resourceRecorder{}
+	err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "../admin"}, recorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder.response.Status != http.StatusBadRequest {
+		t.Fatal("status =", recorder.response.Status)
+	}
+}
@@ -0,0 +1,79 @@
+import React, { ChangeEvent } from 'react';
+import { Button, IconButton, Input, Stack } from '@grafana/ui';
+import { AnnotationRule } from '../types';
+
+interface Props {
+  rules: AnnotationRule[];
+  onChange: (rules: AnnotationRule[]) => void;
+}
+
+// Empty input clears an optional number.
+export const parseNumber = (text: string): number | undefined => (text.trim() === '' ? undefined : Number(text));
+
+/**
+ * Rows mapping an exact value, or a min to max range, to annotation
+ * text and tags. Rules are matched in order.
+ */
+export function AnnotationRulesEditor({ rules, onChange }: Props) {
+  const update = (index: number, rule: Partial<AnnotationRule>) => {
+    onChange(rules.map((each, i) => (i === index ? { ...each, ...rule } : each)));
+  };
+  return (
+    <Stack direction="column" gap={1}>
+      {rules.map((rule, index) => (
+        <Stack key={index} gap={1} alignItems="center">
+          <Input
+            aria-label="Rule value"
+            placeholder="Value"
+            type="number"
+            width={10}
+            value={rule.value ?? ''}
+            onChange={(event: ChangeEvent<HTMLInputElement>) => update(index, { value: parseNumber(event.target.value) })}
+          />
+          <Input
+            aria-label="Rule minimum"
+            placeholder="Min"
+            type="number"
+            width={10}
+            value={rule.min ?? ''}
+            onChange={(event: ChangeEvent<HTMLInputElement>) => update(index, { min: parseNumber(event.target.value) })}
+          />
+          <Input
+            aria-label="Rule maximum"
+            placeholder="Max"
+            type="number"
+            width={10}
+            value={rule.max ?? ''}
+            onChange={(event: ChangeEvent<HTMLInputElement>) => update(index, { max: parseNumber(event.target.value) })}
+          />
+          <Input
+            aria-label="Rule text"
+            placeholder="Text"
+            width={24}
+            value={rule.text}
+            onChange={(event: ChangeEvent<HTMLInputElement>) => update(index, { text: event.target.value })}
+          />
+          <Input
+            aria-label="Rule tags"
+            placeholder="Tags, comma separated"
+            width={24}
+            value={(rule.tags ?? []).join(',')}
+            onChange={(event: ChangeEvent<HTMLInputElement>) =>
+              update(index, { tags: event.target.value.split(',').map((tag) => tag.trim()).filter(Boolean) })
+            }
+          />
+          <IconButton
+            name="trash-alt"
+            tooltip="Remove rule"
+            onClick={() => onChange(rules.filter((_, i) => i !== index))}
+          />
+        </Stack>
+      ))}
+      <div>
+        <Button icon="plus" variant="secondary" size="sm" onClick={() => onChange([...rules, { text: '' }])}>
+          Add rule
+        </Button>
+      </div>
+    </Stack>
+  );
+}
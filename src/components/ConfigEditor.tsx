@@ -1,10 +1,44 @@
 import React, { ChangeEvent } from 'react';
-import { InlineField, Input, SecretInput } from '@grafana/ui';
+import {
+  InlineField,
+  InlineSwitch,
+  Input,
+  SecretInput,
+  SecretTextArea,
+  SecureSocksProxySettings,
+  TLSAuthSettings,
+} from '@grafana/ui';
 import { DataSourcePluginOptionsEditorProps } from '@grafana/data';
+import { config } from '@grafana/runtime';
 import { MyDataSourceOptions, MySecureJsonData } from '../types';
+import { parseNumber } from './AnnotationRulesEditor';
 
 interface Props extends DataSourcePluginOptionsEditorProps<MyDataSourceOptions, MySecureJsonData> {}
 
+// Numeric options, left unset for the backend default when cleared
+type NumberOption =
+  | 'streamInterval'
+  | 'metadataTtl'
+  | 'observationCachePoints'
+  | 'observationSettleMinutes'
+  | 'diskCacheMaxMb'
+  | 'diskCacheAgeHours'
+  | 'rateLimit'
+  | 'rateLimitBurst'
+  | 'retryAttempts'
+  | 'retryMaxDelayMs'
+  | 'connectTimeout'
+  | 'readTimeout'
+  | 'requestTimeout'
+  | 'resourceConcurrency'
+  | 'queryConcurrency';
+// Text options, trimmed by the backend
+type TextOption = 'mqttBrokerUrl' | 'mqttTopicPrefix' | 'mqttUsername' | 'logLevel';
+// Switches other than the TLS options of the HTTP client
+type SwitchOption = 'mqttTlsSkipVerify' | 'diskCache';
+// Secrets beyond the API credentials
+type SecretOption = 'mqttPassword' | 'mqttCaCert';
+
 export function ConfigEditor(props: Props) {
   const { onOptionsChange, options } = props;
   const { jsonData, secureJsonFields, secureJsonData } = options;
@@ -44,6 +78,7 @@ export function ConfigEditor(props: Props) {
     onOptionsChange({
       ...options,
       secureJsonData: {
+        ...options.secureJsonData,
         secretKey: event.target.value,
       },
     });
@@ -68,6 +103,7 @@ export function ConfigEditor(props: Props) {
     onOptionsChange({
       ...options,
       secureJsonData: {
+        ...options.secureJsonData,
         clientId: event.target.value,
       },
     });
@@ -87,6 +123,73 @@ export function ConfigEditor(props: Props) {
     });
   };
 
+  // TLS options read by the SDK when building the HTTP client
+  const onTlsChange =
+    (field: 'tlsAuth' | 'tlsAuthWithCACert' | 'tlsSkipVerify') => (event: ChangeEvent<HTMLInputElement>) => {
+      onOptionsChange({
+        ...options,
+        jsonData: {
+          ...jsonData,
+          [field]: event.currentTarget.checked,
+        },
+      });
+    };
+
+  const onNumberChange = (field: NumberOption) => (event: ChangeEvent<HTMLInputElement>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...jsonData,
+        [field]: parseNumber(event.target.value),
+      },
+    });
+  };
+
+  const onTextChange = (field: TextOption) => (event: ChangeEvent<HTMLInputElement>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...jsonData,
+        [field]: event.target.value,
+      },
+    });
+  };
+
+  const onSwitchChange = (field: SwitchOption) => (event: ChangeEvent<HTMLInputElement>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...jsonData,
+        [field]: event.currentTarget.checked,
+      },
+    });
+  };
+
+  // Secure field (only sent to the backend)
+  const onSecretChange = (field: SecretOption) => (event: ChangeEvent<HTMLInputElement | HTMLTextAreaElement>) => {
+    onOptionsChange({
+      ...options,
+      secureJsonData: {
+        ...options.secureJsonData,
+        [field]: event.target.value,
+      },
+    });
+  };
+
+  const onSecretReset = (field: SecretOption) => () => {
+    onOptionsChange({
+      ...options,
+      secureJsonFields: {
+        ...options.secureJsonFields,
+        [field]: false,
+      },
+      secureJsonData: {
+        ...options.secureJsonData,
+        [field]: '',
+      },
+    });
+  };
+
   return (
     <>
       <InlineField label="Server URL" labelWidth={14} interactive tooltip={'URL of server to use'}>
@@ -140,6 +243,372 @@ export function ConfigEditor(props: Props) {
           onChange={onAPIKeyChange}
         />
       </InlineField>
+      <InlineField
+        label="TLS Client Auth"
+        labelWidth={20}
+        interactive
+        tooltip={'Present a client certificate to the server'}
+      >
+        <InlineSwitch id="config-editor-tls-auth" value={jsonData.tlsAuth ?? false} onChange={onTlsChange('tlsAuth')} />
+      </InlineField>
+      <InlineField
+        label="With CA Cert"
+        labelWidth={20}
+        interactive
+        tooltip={'Verify the server with a custom CA certificate'}
+      >
+        <InlineSwitch
+          id="config-editor-tls-ca"
+          value={jsonData.tlsAuthWithCACert ?? false}
+          onChange={onTlsChange('tlsAuthWithCACert')}
+        />
+      </InlineField>
+      <InlineField label="Skip TLS Verify" labelWidth={20} interactive tooltip={'Accept any server certificate'}>
+        <InlineSwitch
+          id="config-editor-tls-skip-verify"
+          value={jsonData.tlsSkipVerify ?? false}
+          onChange={onTlsChange('tlsSkipVerify')}
+        />
+      </InlineField>
+      {(jsonData.tlsAuth || jsonData.tlsAuthWithCACert) && (
+        <TLSAuthSettings dataSourceConfig={options} onChange={onOptionsChange} />
+      )}
+      <InlineField
+        label="Stream Interval"
+        labelWidth={20}
+        interactive
+        tooltip={'Seconds between polls for new observations on live channels'}
+      >
+        <Input
+          id="config-editor-stream-interval"
+          type="number"
+          onChange={onNumberChange('streamInterval')}
+          value={jsonData.streamInterval ?? ''}
+          placeholder="10"
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="MQTT Broker URL"
+        labelWidth={20}
+        interactive
+        tooltip={'SensorThings MQTT broker feeding live channels, polling when empty'}
+      >
+        <Input
+          id="config-editor-mqtt-broker-url"
+          onChange={onTextChange('mqttBrokerUrl')}
+          value={jsonData.mqttBrokerUrl ?? ''}
+          placeholder="ssl://broker:8883"
+          width={40}
+        />
+      </InlineField>
+      {jsonData.mqttBrokerUrl && (
+        <>
+          <InlineField
+            label="MQTT Topic Prefix"
+            labelWidth={20}
+            interactive
+            tooltip={'Topic levels before Datastreams(id)/Observations'}
+          >
+            <Input
+              id="config-editor-mqtt-topic-prefix"
+              onChange={onTextChange('mqttTopicPrefix')}
+              value={jsonData.mqttTopicPrefix ?? ''}
+              placeholder="v1.1"
+              width={40}
+            />
+          </InlineField>
+          <InlineField label="MQTT Username" labelWidth={20} interactive tooltip={'Broker username'}>
+            <Input
+              id="config-editor-mqtt-username"
+              onChange={onTextChange('mqttUsername')}
+              value={jsonData.mqttUsername ?? ''}
+              width={40}
+            />
+          </InlineField>
+          <InlineField label="MQTT Password" labelWidth={20} interactive tooltip={'Broker password'}>
+            <SecretInput
+              id="config-editor-mqtt-password"
+              isConfigured={secureJsonFields.mqttPassword}
+              value={secureJsonData?.mqttPassword}
+              width={40}
+              onReset={onSecretReset('mqttPassword')}
+              onChange={onSecretChange('mqttPassword')}
+            />
+          </InlineField>
+          <InlineField
+            label="MQTT CA Cert"
+            labelWidth={20}
+            interactive
+            tooltip={'PEM encoded certificate to verify the broker with'}
+          >
+            <SecretTextArea
+              id="config-editor-mqtt-ca-cert"
+              isConfigured={secureJsonFields.mqttCaCert}
+              value={secureJsonData?.mqttCaCert}
+              placeholder="-----BEGIN CERTIFICATE-----"
+              cols={45}
+              rows={5}
+              onReset={onSecretReset('mqttCaCert')}
+              onChange={onSecretChange('mqttCaCert')}
+            />
+          </InlineField>
+          <InlineField
+            label="MQTT Skip TLS Verify"
+            labelWidth={20}
+            interactive
+            tooltip={'Accept any broker certificate'}
+          >
+            <InlineSwitch
+              id="config-editor-mqtt-tls-skip-verify"
+              value={jsonData.mqttTlsSkipVerify ?? false}
+              onChange={onSwitchChange('mqttTlsSkipVerify')}
+            />
+          </InlineField>
+        </>
+      )}
+      <InlineField
+        label="Metadata TTL"
+        labelWidth={20}
+        interactive
+        tooltip={'Seconds to cache things and datastreams, negative to disable'}
+      >
+        <Input
+          id="config-editor-metadata-ttl"
+          type="number"
+          onChange={onNumberChange('metadataTtl')}
+          value={jsonData.metadataTtl ?? ''}
+          placeholder="300"
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="Cached Observations"
+        labelWidth={20}
+        interactive
+        tooltip={'Observations kept in memory, negative to disable caching'}
+      >
+        <Input
+          id="config-editor-observation-cache-points"
+          type="number"
+          onChange={onNumberChange('observationCachePoints')}
+          value={jsonData.observationCachePoints ?? ''}
+          placeholder="1000000"
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="Settle Minutes"
+        labelWidth={20}
+        interactive
+        tooltip={'Minutes before recent observations are cached as complete'}
+      >
+        <Input
+          id="config-editor-observation-settle-minutes"
+          type="number"
+          onChange={onNumberChange('observationSettleMinutes')}
+          value={jsonData.observationSettleMinutes ?? ''}
+          placeholder="5"
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="Disk Cache"
+        labelWidth={20}
+        interactive
+        tooltip={'Persist historical observations and metadata across restarts'}
+      >
+        <InlineSwitch
+          id="config-editor-disk-cache"
+          value={jsonData.diskCache ?? false}
+          onChange={onSwitchChange('diskCache')}
+        />
+      </InlineField>
+      {jsonData.diskCache && (
+        <>
+          <InlineField
+            label="Disk Cache Size"
+            labelWidth={20}
+            interactive
+            tooltip={'Size cap of the cache file in megabytes'}
+          >
+            <Input
+              id="config-editor-disk-cache-max-mb"
+              type="number"
+              onChange={onNumberChange('diskCacheMaxMb')}
+              value={jsonData.diskCacheMaxMb ?? ''}
+              placeholder="512"
+              width={40}
+            />
+          </InlineField>
+          <InlineField
+            label="Disk Cache Age"
+            labelWidth={20}
+            interactive
+            tooltip={'Hours after which observations are considered immutable and persisted'}
+          >
+            <Input
+              id="config-editor-disk-cache-age-hours"
+              type="number"
+              onChange={onNumberChange('diskCacheAgeHours')}
+              value={jsonData.diskCacheAgeHours ?? ''}
+              placeholder="24"
+              width={40}
+            />
+          </InlineField>
+        </>
+      )}
+      <InlineField
+        label="Rate Limit"
+        labelWidth={20}
+        interactive
+        tooltip={'Upstream requests per second, unlimited when empty'}
+      >
+        <Input
+          id="config-editor-rate-limit"
+          type="number"
+          onChange={onNumberChange('rateLimit')}
+          value={jsonData.rateLimit ?? ''}
+          placeholder="0"
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="Rate Limit Burst"
+        labelWidth={20}
+        interactive
+        tooltip={'Requests allowed in a burst above the rate, one second of requests when empty'}
+      >
+        <Input
+          id="config-editor-rate-limit-burst"
+          type="number"
+          onChange={onNumberChange('rateLimitBurst')}
+          value={jsonData.rateLimitBurst ?? ''}
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="Retry Attempts"
+        labelWidth={20}
+        interactive
+        tooltip={'Attempts per upstream request including the first, 1 to disable retries'}
+      >
+        <Input
+          id="config-editor-retry-attempts"
+          type="number"
+          onChange={onNumberChange('retryAttempts')}
+          value={jsonData.retryAttempts ?? ''}
+          placeholder="3"
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="Retry Max Delay"
+        labelWidth={20}
+        interactive
+        tooltip={'Longest backoff between attempts in milliseconds'}
+      >
+        <Input
+          id="config-editor-retry-max-delay"
+          type="number"
+          onChange={onNumberChange('retryMaxDelayMs')}
+          value={jsonData.retryMaxDelayMs ?? ''}
+          placeholder="5000"
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="Connect Timeout"
+        labelWidth={20}
+        interactive
+        tooltip={'Seconds allowed to establish a connection'}
+      >
+        <Input
+          id="config-editor-connect-timeout"
+          type="number"
+          onChange={onNumberChange('connectTimeout')}
+          value={jsonData.connectTimeout ?? ''}
+          placeholder="10"
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="Read Timeout"
+        labelWidth={20}
+        interactive
+        tooltip={'Seconds allowed for response headers after sending a request'}
+      >
+        <Input
+          id="config-editor-read-timeout"
+          type="number"
+          onChange={onNumberChange('readTimeout')}
+          value={jsonData.readTimeout ?? ''}
+          placeholder="30"
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="Request Timeout"
+        labelWidth={20}
+        interactive
+        tooltip={'Seconds allowed for an upstream request including retries'}
+      >
+        <Input
+          id="config-editor-request-timeout"
+          type="number"
+          onChange={onNumberChange('requestTimeout')}
+          value={jsonData.requestTimeout ?? ''}
+          placeholder="60"
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="Resource Concurrency"
+        labelWidth={20}
+        interactive
+        tooltip={'Datastream lookups in flight when listing things'}
+      >
+        <Input
+          id="config-editor-resource-concurrency"
+          type="number"
+          onChange={onNumberChange('resourceConcurrency')}
+          value={jsonData.resourceConcurrency ?? ''}
+          placeholder="8"
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="Query Concurrency"
+        labelWidth={20}
+        interactive
+        tooltip={'Queries running at once for this datasource'}
+      >
+        <Input
+          id="config-editor-query-concurrency"
+          type="number"
+          onChange={onNumberChange('queryConcurrency')}
+          value={jsonData.queryConcurrency ?? ''}
+          placeholder="8"
+          width={40}
+        />
+      </InlineField>
+      <InlineField
+        label="Log Level"
+        labelWidth={20}
+        interactive
+        tooltip={'Verbosity of backend logs: debug, info, warn or error'}
+      >
+        <Input
+          id="config-editor-log-level"
+          onChange={onTextChange('logLevel')}
+          value={jsonData.logLevel ?? ''}
+          placeholder="info"
+          width={40}
+        />
+      </InlineField>
+      {config.secureSocksDSProxyEnabled && (
+        <SecureSocksProxySettings options={options} onOptionsChange={onOptionsChange} />
+      )}
     </>
   );
 }
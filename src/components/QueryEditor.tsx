@@ -1,12 +1,39 @@
-import React, { useState } from 'react';
-import { Field, Stack, Combobox, ComboboxOption, MultiCombobox } from '@grafana/ui';
-import { QueryEditorProps } from '@grafana/data';
+import React, { ChangeEvent, useState } from 'react';
+import { Field, Stack, Combobox, ComboboxOption, MultiCombobox, RadioButtonGroup, Input, InlineSwitch } from '@grafana/ui';
+import { QueryEditorProps, SelectableValue } from '@grafana/data';
 import { DataSource } from '../datasource';
-import { MyDataSourceOptions, ObservationQuery, ThingWithDataStreams, DataStream } from '../types';
+import { MyDataSourceOptions, ObservationQuery, ThingWithDataStreams, DataStream, QueryType } from '../types';
+import { AnnotationRulesEditor, parseNumber } from './AnnotationRulesEditor';
 
 // Data stream lookup by thing ID.
 type DataStreams = Record<string, ComboboxOption[]>;
 
+const QUERY_TYPES: Array<SelectableValue<QueryType>> = [
+  { label: 'Observations', value: '' },
+  { label: 'Calendar', value: 'calendar', description: 'Aggregate into calendar buckets' },
+  { label: 'Threshold', value: 'threshold', description: 'Intervals past a threshold' },
+  { label: 'Anomaly', value: 'anomaly', description: 'Spikes, dropouts and flat lines' },
+  { label: 'Annotations', value: 'annotations', description: 'Map values to annotation text' },
+];
+
+const INTERVALS: ComboboxOption[] = ['hour', 'day', 'week', 'month', 'year'].map((value) => ({ label: value, value }));
+
+const DIRECTIONS: Array<SelectableValue<'above' | 'below'>> = [
+  { label: 'Above', value: 'above' },
+  { label: 'Below', value: 'below' },
+];
+
+const METHODS: ComboboxOption[] = [
+  { label: 'Z-score', value: 'zscore' },
+  { label: 'Hampel', value: 'hampel' },
+  { label: 'Flat line', value: 'flatline' },
+  { label: 'Rate of change', value: 'rate' },
+];
+
+// Queries saved before the ids were an array hold them comma separated.
+const selectedDataStreams = (ids: string[] | string | undefined): string[] =>
+  typeof ids === 'string' ? ids.split(',').filter(Boolean) : ids ?? [];
+
 /**
  * Query uses backend data to populate interface with available
  * resource labels and identifiers.
@@ -28,10 +55,15 @@ export function QueryEditor({
     setDataStreamOptions(dataStreams[option.value]);
     onChange({ ...query, thingId: option.value });
   };
-  // Format selection as query string for backend request
+  // Selected datastream ids, which the backend also applies to alert queries
   const onMultiComboboxChange = (value: ComboboxOption[]) => {
-    const queryString = value.map((each) => each.value).join(',');
-    onChange({ ...query, dataStreamIds: queryString });
+    onChange({ ...query, dataStreamIds: value.map((each) => each.value) });
+  };
+  const queryType = query.queryType ?? '';
+  const detector = query.detector ?? {};
+  // Update one option of the anomaly detector
+  const onDetectorChange = (options: Partial<NonNullable<ObservationQuery['detector']>>) => {
+    onChange({ ...query, detector: { ...detector, ...options } });
   };
   /**
    * Get and parse nodes to collect data using the datasource
@@ -72,11 +104,184 @@ export function QueryEditor({
           <MultiCombobox
             id="query-editor-data-stream-id"
             options={dataStreamOptions}
+            value={selectedDataStreams(query.dataStreamIds)}
             onChange={onMultiComboboxChange}
             enableAllOption={true} // Allow selecting all data streams
           />
         </Field>
       </Stack>
+      <Field label="Query type">
+        <RadioButtonGroup<QueryType>
+          options={QUERY_TYPES}
+          value={queryType}
+          onChange={(value) => onChange({ ...query, queryType: value })}
+        />
+      </Field>
+      {queryType === '' && (
+        <Field label="Live" description="Append new observations as they arrive">
+          <InlineSwitch
+            value={query.live ?? false}
+            onChange={(event: ChangeEvent<HTMLInputElement>) => onChange({ ...query, live: event.target.checked })}
+          />
+        </Field>
+      )}
+      {queryType !== '' && queryType !== 'calendar' && (
+        <Field label="Analyzed data stream" description="All data streams of the thing when empty">
+          <Combobox
+            id="query-editor-analyzed-data-stream"
+            options={dataStreamOptions}
+            value={query.dataStreamId ?? null}
+            isClearable
+            onChange={(option: ComboboxOption | null) => onChange({ ...query, dataStreamId: option?.value })}
+          />
+        </Field>
+      )}
+      {queryType === 'calendar' && (
+        <Stack gap={1}>
+          <Field label="Interval">
+            <Combobox
+              id="query-editor-interval"
+              options={INTERVALS}
+              value={query.interval ?? 'day'}
+              onChange={(option: ComboboxOption) =>
+                onChange({ ...query, interval: option.value as ObservationQuery['interval'] })
+              }
+            />
+          </Field>
+          <Field label="Timezone" description="IANA name, UTC when empty">
+            <Input
+              id="query-editor-timezone"
+              placeholder="America/New_York"
+              value={query.timezone ?? ''}
+              onChange={(event: ChangeEvent<HTMLInputElement>) => onChange({ ...query, timezone: event.target.value })}
+            />
+          </Field>
+          <Field label="Percentiles" description="Comma separated, 0 to 100">
+            <Input
+              id="query-editor-percentiles"
+              placeholder="50"
+              defaultValue={(query.percentiles ?? []).join(',')}
+              onBlur={(event: ChangeEvent<HTMLInputElement>) =>
+                onChange({
+                  ...query,
+                  percentiles: event.target.value
+                    .split(',')
+                    .map((each) => parseNumber(each))
+                    .filter((each): each is number => each !== undefined && !isNaN(each)),
+                })
+              }
+            />
+          </Field>
+        </Stack>
+      )}
+      {queryType === 'threshold' && (
+        <Stack gap={1}>
+          <Field label="Threshold">
+            <Input
+              id="query-editor-threshold"
+              type="number"
+              value={query.threshold ?? ''}
+              onChange={(event: ChangeEvent<HTMLInputElement>) =>
+                onChange({ ...query, threshold: parseNumber(event.target.value) })
+              }
+            />
+          </Field>
+          <Field label="Direction">
+            <RadioButtonGroup
+              options={DIRECTIONS}
+              value={query.direction ?? 'above'}
+              onChange={(value) => onChange({ ...query, direction: value })}
+            />
+          </Field>
+        </Stack>
+      )}
+      {queryType === 'anomaly' && (
+        <Stack gap={1} wrap="wrap">
+          <Field label="Methods" description="Z-score, Hampel and flat line when empty">
+            <MultiCombobox
+              id="query-editor-methods"
+              options={METHODS}
+              value={detector.methods ?? []}
+              onChange={(value: ComboboxOption[]) =>
+                onDetectorChange({
+                  methods: value.map((each) => each.value as NonNullable<typeof detector.methods>[number]),
+                })
+              }
+            />
+          </Field>
+          <Field label="Window" description="Samples">
+            <Input
+              type="number"
+              placeholder="11"
+              value={detector.window ?? ''}
+              onChange={(event: ChangeEvent<HTMLInputElement>) =>
+                onDetectorChange({ window: parseNumber(event.target.value) })
+              }
+            />
+          </Field>
+          <Field label="Z-score">
+            <Input
+              type="number"
+              placeholder="3"
+              value={detector.zScore ?? ''}
+              onChange={(event: ChangeEvent<HTMLInputElement>) =>
+                onDetectorChange({ zScore: parseNumber(event.target.value) })
+              }
+            />
+          </Field>
+          <Field label="Hampel k">
+            <Input
+              type="number"
+              value={detector.hampelK ?? ''}
+              onChange={(event: ChangeEvent<HTMLInputElement>) =>
+                onDetectorChange({ hampelK: parseNumber(event.target.value) })
+              }
+            />
+          </Field>
+          <Field label="Flat line" description="Identical samples">
+            <Input
+              type="number"
+              value={detector.flatLine ?? ''}
+              onChange={(event: ChangeEvent<HTMLInputElement>) =>
+                onDetectorChange({ flatLine: parseNumber(event.target.value) })
+              }
+            />
+          </Field>
+          <Field label="Max rate" description="Change per second">
+            <Input
+              type="number"
+              value={detector.maxRate ?? ''}
+              onChange={(event: ChangeEvent<HTMLInputElement>) =>
+                onDetectorChange({ maxRate: parseNumber(event.target.value) })
+              }
+            />
+          </Field>
+          <Field label="Mask flagged points">
+            <InlineSwitch
+              value={detector.mask ?? false}
+              onChange={(event: ChangeEvent<HTMLInputElement>) => onDetectorChange({ mask: event.target.checked })}
+            />
+          </Field>
+        </Stack>
+      )}
+      {queryType === 'annotations' && (
+        <>
+          <Field label="Rules" description="Exact value or min to max range, matched in order">
+            <AnnotationRulesEditor
+              rules={query.rules ?? []}
+              onChange={(rules) => onChange({ ...query, rules })}
+            />
+          </Field>
+          <Field label="Changes only" description="One annotation per run of the same rule">
+            <InlineSwitch
+              value={query.changesOnly ?? false}
+              onChange={(event: ChangeEvent<HTMLInputElement>) =>
+                onChange({ ...query, changesOnly: event.target.checked })
+              }
+            />
+          </Field>
+        </>
+      )}
     </div>
   );
 }
@@ -1,11 +1,18 @@
-import { DataSourceInstanceSettings, CoreApp } from '@grafana/data';
+import { AnnotationQuery, DataSourceInstanceSettings, CoreApp } from '@grafana/data';
 import { DataSourceWithBackend } from '@grafana/runtime';
 
-import { ObservationQuery, MyDataSourceOptions, DEFAULT_QUERY } from './types';
+import { ObservationQuery, MyDataSourceOptions, DEFAULT_QUERY, DEFAULT_ANNOTATION_QUERY } from './types';
 
 export class DataSource extends DataSourceWithBackend<ObservationQuery, MyDataSourceOptions> {
   constructor(instanceSettings: DataSourceInstanceSettings<MyDataSourceOptions>) {
     super(instanceSettings);
+    // Annotation queries use the query editor, starting in annotation mode
+    this.annotations = {
+      prepareAnnotation: (annotation: AnnotationQuery<ObservationQuery>) => ({
+        ...annotation,
+        target: { ...DEFAULT_ANNOTATION_QUERY, refId: 'Anno', ...annotation.target } as ObservationQuery,
+      }),
+    };
   }
 
   getDefaultQuery(_: CoreApp): Partial<ObservationQuery> {
@@ -1,9 +1,41 @@
 import { DataSourceJsonData } from '@grafana/data';
 import { DataQuery } from '@grafana/schema';
 
+/**
+ * Backend query types, with raw observations when unset
+ */
+export type QueryType = '' | 'calendar' | 'threshold' | 'anomaly' | 'annotations';
+
 export interface ObservationQuery extends DataQuery {
+  queryType?: QueryType;
   thingId: string;
-  dataStreamIds?: string;
+  dataStreamIds?: string[];
+  interval?: 'hour' | 'day' | 'week' | 'month' | 'year';
+  timezone?: string;
+  percentiles?: number[];
+  dataStreamId?: string;
+  threshold?: number;
+  direction?: 'above' | 'below';
+  detector?: {
+    methods?: Array<'zscore' | 'hampel' | 'flatline' | 'rate'>;
+    window?: number;
+    zScore?: number;
+    hampelK?: number;
+    flatLine?: number;
+    maxRate?: number;
+    mask?: boolean;
+  };
+  rules?: AnnotationRule[];
+  changesOnly?: boolean;
+  live?: boolean;
+}
+
+export type AnnotationRule = {
+  value?: number
+  min?: number
+  max?: number
+  text: string
+  tags?: string[]
 }
 
 
@@ -35,6 +67,12 @@ export const DEFAULT_QUERY: Partial<ObservationQuery> = {
   thingId: "",
 };
 
+export const DEFAULT_ANNOTATION_QUERY: Partial<ObservationQuery> = {
+  queryType: 'annotations',
+  thingId: "",
+  changesOnly: true,
+};
+
 /**
  * These are options configured for each DataSource instance
  */
@@ -42,6 +80,32 @@ export interface MyDataSourceOptions extends DataSourceJsonData {
   basePath?: string
   serverUrl?: string
   authMethod?: string
+  resourceConcurrency?: number
+  queryConcurrency?: number
+  metadataTtl?: number
+  observationCachePoints?: number
+  observationSettleMinutes?: number
+  diskCache?: boolean
+  diskCacheMaxMb?: number
+  diskCacheAgeHours?: number
+  streamInterval?: number
+  mqttBrokerUrl?: string
+  mqttTopicPrefix?: string
+  mqttUsername?: string
+  mqttTlsSkipVerify?: boolean
+  rateLimit?: number
+  rateLimitBurst?: number
+  retryAttempts?: number
+  retryMaxDelayMs?: number
+  connectTimeout?: number
+  readTimeout?: number
+  requestTimeout?: number
+  tlsAuth?: boolean
+  tlsAuthWithCACert?: boolean
+  tlsSkipVerify?: boolean
+  serverName?: string
+  enableSecureSocksProxy?: boolean
+  logLevel?: string
 }
 
 /**
@@ -50,4 +114,9 @@ export interface MyDataSourceOptions extends DataSourceJsonData {
 export interface MySecureJsonData {
   secretKey?: string;
   clientId?: string;
+  mqttPassword?: string;
+  mqttCaCert?: string;
+  tlsCACert?: string;
+  tlsClientCert?: string;
+  tlsClientKey?: string;
 }